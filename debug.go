@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+// findTarget returns the active target with the given prefix
+func findTarget(prefix string) (config.Target, bool) {
+	for _, t := range currentTargets() {
+		if t.Prefix == prefix {
+			return t, true
+		}
+	}
+	return config.Target{}, false
+}
+
+// handleRawResponse returns the unparsed response of a target, e.g.
+// /debug/raw?target=sipproxyd, to diagnose parse failures. The target is
+// queried the same way as for a normal scrape.
+func handleRawResponse(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("target")
+	target, ok := findTarget(prefix)
+	if !ok {
+		http.Error(w, "unknown target "+prefix, http.StatusNotFound)
+		return
+	}
+	c5Req, err := newTargetRequest(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	transport, err := transportFor(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	client := http.Client{Timeout: timeoutFor(target), Transport: transport}
+	resp, err := client.Do(c5Req.WithContext(req.Context()))
+	if err != nil {
+		logError("Failed to connect", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logError("Failed to copy raw response of", prefix, err)
+	}
+}
+
+// Maximum interval between the scrapes of /debug/delta
+const maxDeltaInterval = time.Minute
+
+// Prefix of the private targets queried by /debug/delta
+const deltaPrefix = "debug_delta_"
+
+// snapshotMetrics returns the current values of all metrics of a target in
+// the given set
+func snapshotMetrics(set *metrics.Set, prefix string) map[string]float64 {
+	var buf bytes.Buffer
+	set.WritePrometheus(&buf)
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix+"_") && !strings.HasPrefix(line, prefix+"{") {
+			continue
+		}
+		n := strings.LastIndexByte(line, ' ')
+		if n < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[n+1:], 64)
+		if err != nil {
+			continue
+		}
+		values[line[:n]] = v
+	}
+	return values
+}
+
+// handleDelta scrapes a target twice, by default a second apart, and returns
+// the changes of all metrics in between, e.g. /debug/delta?target=sipproxyd.
+// This shows which counters are actually moving without a Prometheus server.
+// The target is queried using a private prefix and metric set, so the
+// exposed metrics, the _delta baselines and the throttling of the Prometheus
+// scrapes are not affected.
+func handleDelta(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("target")
+	target, ok := findTarget(prefix)
+	if !ok {
+		http.Error(w, "unknown target "+prefix, http.StatusNotFound)
+		return
+	}
+	interval := time.Second
+	if s := req.URL.Query().Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxDeltaInterval {
+			http.Error(w, "invalid interval "+s, http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+	private := target
+	private.Prefix = deltaPrefix + prefix
+	set := metrics.NewSet()
+	privateSetsMu.Lock()
+	if _, ok := privateSets[private.Prefix]; ok {
+		privateSetsMu.Unlock()
+		http.Error(w, "delta of target "+prefix+" already in progress", http.StatusConflict)
+		return
+	}
+	privateSets[private.Prefix] = set
+	privateSetsMu.Unlock()
+	defer func() {
+		privateSetsMu.Lock()
+		delete(privateSets, private.Prefix)
+		privateSetsMu.Unlock()
+		clearProcessMetrics(private.Prefix)
+	}()
+	scrape := func() (map[string]float64, bool) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		fetchC5StateMetrics(req.Context(), private, &wg)
+		resetScrapeThrottle(private.Prefix)
+		return snapshotMetrics(set, private.Prefix), lastScrapeSucceeded(private.Prefix)
+	}
+	before, ok := scrape()
+	if !ok {
+		http.Error(w, "failed to scrape target "+prefix, http.StatusBadGateway)
+		return
+	}
+	select {
+	case <-time.After(interval):
+	case <-req.Context().Done():
+		return
+	}
+	after, ok := scrape()
+	if !ok {
+		http.Error(w, "failed to scrape target "+prefix, http.StatusBadGateway)
+		return
+	}
+	var names []string
+	for name, v := range after {
+		if v != before[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %g\n", prefix+strings.TrimPrefix(name, private.Prefix), after[name]-before[name])
+	}
+}
+
+// handleScrape immediately queries all targets or the given one, e.g.
+// POST /-/scrape?target=sipproxyd, regardless of the minimum scrape interval.
+// It returns the success per target once the queries finished or the scrape
+// deadline passed, "disabled" for targets disabled using /-/disable and
+// "removed" for targets removed by a reload meanwhile.
+func handleScrape(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := currentTargets()
+	if prefix := req.URL.Query().Get("target"); prefix != "" {
+		target, ok := findTarget(prefix)
+		if !ok {
+			http.Error(w, "unknown target "+prefix, http.StatusNotFound)
+			return
+		}
+		list = []config.Target{target}
+	}
+	for _, t := range list {
+		resetScrapeThrottle(t.Prefix)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), scrapeDeadline())
+	defer cancel()
+	scrapeTargets(ctx, list, scrapeParallelism())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, t := range list {
+		// Read from the target state, registering c5_scrape_success again
+		// would expose it for disabled or meanwhile removed targets
+		if _, ok := findTarget(t.Prefix); !ok {
+			fmt.Fprintf(w, "%s removed\n", t.Prefix)
+			continue
+		}
+		switch {
+		case scrapeDisabled(t.Prefix):
+			fmt.Fprintf(w, "%s disabled\n", t.Prefix)
+		case lastScrapeSucceeded(t.Prefix):
+			fmt.Fprintf(w, "%s 1\n", t.Prefix)
+		default:
+			fmt.Fprintf(w, "%s 0\n", t.Prefix)
+		}
+	}
+}
+
+// Default and maximum duration targets are disabled using /-/disable
+const (
+	defaultDisableTTL = time.Hour
+	maxDisableTTL     = 24 * time.Hour
+)
+
+// handleDisable stops querying a target for some time, by default an hour,
+// e.g. POST /-/disable?target=sipproxyd&ttl=30m during a planned restart.
+// POST /-/enable?target=sipproxyd resumes querying it earlier.
+func handleDisable(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := req.URL.Query().Get("target")
+	if _, ok := findTarget(prefix); !ok {
+		http.Error(w, "unknown target "+prefix, http.StatusNotFound)
+		return
+	}
+	if req.URL.Path == "/-/enable" {
+		enableTarget(prefix)
+		fmt.Fprintln(w, prefix, "enabled")
+		return
+	}
+	ttl := defaultDisableTTL
+	if s := req.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxDisableTTL {
+			http.Error(w, "invalid ttl "+s, http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	until := time.Now().Add(ttl)
+	disableTarget(prefix, until)
+	fmt.Fprintln(w, prefix, "disabled until", until.Format(time.RFC3339))
+}
+
+// handleCardinality lists the number of series of each metric of a target,
+// most first, e.g. /debug/cardinality?target=sipproxyd. Multi-line counters
+// with many idx labels show up on top.
+func handleCardinality(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("target")
+	if _, ok := findTarget(prefix); !ok {
+		http.Error(w, "unknown target "+prefix, http.StatusNotFound)
+		return
+	}
+	var prefixes []string
+	for _, t := range currentTargets() {
+		prefixes = append(prefixes, t.Prefix)
+	}
+	series := map[string]int{}
+	for _, name := range metricSet.ListMetricNames() {
+		if longestPrefix(name, prefixes) != prefix {
+			continue
+		}
+		if n := strings.IndexByte(name, '{'); n >= 0 {
+			name = name[:n]
+		}
+		series[name]++
+	}
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if series[names[i]] != series[names[j]] {
+			return series[names[i]] > series[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %d\n", name, series[name])
+	}
+}
+
+// newAdminHandler returns the handler of the admin listener serving the
+// debug endpoints, which must not be exposed with the metrics. The pprof
+// and cardinality endpoints are only added if enabled.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/raw", handleRawResponse)
+	mux.HandleFunc("/debug/delta", handleDelta)
+	mux.HandleFunc("/-/scrape", handleScrape)
+	mux.HandleFunc("/-/disable", handleDisable)
+	mux.HandleFunc("/-/enable", handleDisable)
+	if config.AppConfig.CardinalityReport {
+		mux.HandleFunc("/debug/cardinality", handleCardinality)
+	}
+	if config.AppConfig.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+func Test_handleRawResponse(t *testing.T) {
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_raw", URL: c5.URL}})
+
+	admin := httptest.NewServer(newAdminHandler())
+	defer admin.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{"known target", "test_raw", http.StatusOK, testStateResponse},
+		{"unknown target", "test_unknown", http.StatusNotFound, "unknown target test_unknown\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(admin.URL + "/debug/raw?target=" + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.status)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func Test_handleDelta(t *testing.T) {
+	var scrapes int64
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Only the absolute value of TRANSPORT_MESSAGE_IN is increasing
+		if atomic.AddInt64(&scrapes, 1) > 1 {
+			w.Write([]byte(strings.Replace(testStateResponse, "6502", "6510", 1)))
+			return
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_delta", URL: c5.URL}})
+	defer clearMetrics("test_delta")
+
+	admin := httptest.NewServer(newAdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/debug/delta?target=test_delta&interval=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if want := "test_delta_transport_message_in_total 8\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	// The private queries neither expose metrics nor keep any state
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.Contains(name, "test_delta") {
+			t.Errorf("handleDelta() registered %s", name)
+		}
+	}
+	statesMu.Lock()
+	for prefix := range states {
+		if strings.Contains(prefix, "test_delta") {
+			t.Errorf("handleDelta() kept the state of %s", prefix)
+		}
+	}
+	statesMu.Unlock()
+
+	resp, err = http.Get(admin.URL + "/debug/delta?target=test_delta&interval=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status for invalid interval = %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_handleScrape(t *testing.T) {
+	var queries int64
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&queries, 1)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_scrape1", URL: c5.URL + "/1"}, {Prefix: "test_scrape2", URL: c5.URL + "/2"}})
+	defer clearMetrics("test_scrape")
+	defer func() { config.AppConfig.MinScrapeInterval.Duration = 0 }()
+	config.AppConfig.MinScrapeInterval.Duration = time.Hour
+
+	admin := httptest.NewServer(newAdminHandler())
+	defer admin.Close()
+	tests := []struct {
+		name    string
+		method  string
+		query   string
+		status  int
+		body    string
+		queries int64
+	}{
+		{"all targets", http.MethodPost, "", http.StatusOK, "test_scrape1 1\ntest_scrape2 1\n", 2},
+		{"single target again", http.MethodPost, "?target=test_scrape2", http.StatusOK, "test_scrape2 1\n", 3},
+		{"unknown target", http.MethodPost, "?target=test_unknown", http.StatusNotFound, "", 3},
+		{"get", http.MethodGet, "", http.StatusMethodNotAllowed, "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, admin.URL+"/-/scrape"+tt.query, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := atomic.LoadInt64(&queries); got != tt.queries {
+				t.Errorf("C5 queries = %v, want %v", got, tt.queries)
+			}
+		})
+	}
+
+	// A disabled target is reported as such, without exposing its status again
+	disableTarget("test_scrape2", time.Now().Add(time.Minute))
+	defer enableTarget("test_scrape2")
+	req, _ := http.NewRequest(http.MethodPost, admin.URL+"/-/scrape", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if want := "test_scrape1 1\ntest_scrape2 disabled\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	for _, name := range metricSet.ListMetricNames() {
+		if name == `c5_scrape_success{target="test_scrape2"}` {
+			t.Errorf("handleScrape() registered %s of the disabled target", name)
+		}
+	}
+}
+
+func Test_handleDisable(t *testing.T) {
+	var queries int64
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&queries, 1)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	target := config.Target{Prefix: "test_disable", URL: c5.URL}
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{target})
+	defer clearMetrics("test_disable")
+	disabled := metricSet.GetOrCreateCounter(`c5_target_disabled{target="test_disable"}`)
+
+	admin := httptest.NewServer(newAdminHandler())
+	defer admin.Close()
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		disabled uint64
+		queries  int64
+	}{
+		{"disable", "/-/disable?target=test_disable&ttl=10m", http.StatusOK, 1, 0},
+		{"invalid ttl", "/-/disable?target=test_disable&ttl=48h", http.StatusBadRequest, 1, 0},
+		{"unknown target", "/-/disable?target=test_unknown", http.StatusNotFound, 1, 0},
+		{"enable", "/-/enable?target=test_disable", http.StatusOK, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&queries, 0)
+			resp, err := http.Post(admin.URL+tt.path, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.status)
+			}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), target, &wg)
+			if got := disabled.Get(); got != tt.disabled {
+				t.Errorf("c5_target_disabled = %v, want %v", got, tt.disabled)
+			}
+			if got := atomic.LoadInt64(&queries); got != tt.queries {
+				t.Errorf("C5 queries = %v, want %v", got, tt.queries)
+			}
+		})
+	}
+
+	// Metrics describing the last query are dropped with the target's metrics
+	stale := []string{
+		`c5_scrape_success{target="test_disable"}`,
+		`c5_scrape_duration_seconds{target="test_disable"}`,
+		`c5_test_disable_up`,
+		`c5_test_disable_memory_parser{impl="regex"}`,
+		`test_disable_state`,
+	}
+	registered := func() map[string]bool {
+		names := map[string]bool{}
+		for _, name := range metricSet.ListMetricNames() {
+			names[name] = true
+		}
+		return names
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, wg)
+	names := registered()
+	for _, name := range stale {
+		if !names[name] {
+			t.Fatalf("fetchC5StateMetrics() did not register %s", name)
+		}
+	}
+	disableTarget("test_disable", time.Now().Add(time.Minute))
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, wg)
+	names = registered()
+	for _, name := range stale {
+		if names[name] {
+			t.Errorf("fetchC5StateMetrics() of disabled target kept %s", name)
+		}
+	}
+
+	// Targets are enabled again after the TTL
+	disableTarget("test_disable", time.Now().Add(-time.Second))
+	if scrapeDisabled("test_disable") || disabled.Get() != 0 {
+		t.Errorf("scrapeDisabled() = true after the TTL, c5_target_disabled = %v", disabled.Get())
+	}
+}
+
+func Test_newAdminHandlerPprof(t *testing.T) {
+	defer func() { config.AppConfig.Pprof = false }()
+	tests := []struct {
+		name   string
+		pprof  bool
+		status int
+	}{
+		{"disabled", false, http.StatusNotFound},
+		{"enabled", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.Pprof = tt.pprof
+			admin := httptest.NewServer(newAdminHandler())
+			defer admin.Close()
+			resp, err := http.Get(admin.URL + "/debug/pprof/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.status)
+			}
+		})
+	}
+	// pprof must never be exposed on the metrics listener
+	config.AppConfig.Pprof = true
+	srv := httptest.NewServer(newMetricsHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("metrics listener pprof status = %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func Test_handleCardinality(t *testing.T) {
+	defer func() { config.AppConfig.CardinalityReport = false }()
+	config.AppConfig.CardinalityReport = true
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_card"}, {Prefix: "test_card_b"}})
+	defer clearMetrics("test_card")
+	defer clearMetrics("test_card_b")
+	for _, name := range []string{
+		"test_card_state",
+		`test_card_queue_size_lastmax{idx="0"}`,
+		`test_card_queue_size_lastmax{idx="1"}`,
+		`test_card_queue_size_lastmax{idx="2"}`,
+		`test_card_errors_total{idx="0"}`,
+		`test_card_errors_total{idx="1"}`,
+		"test_card_b_state",
+	} {
+		metricSet.GetOrCreateCounter(name).Set(1)
+	}
+
+	admin := httptest.NewServer(newAdminHandler())
+	defer admin.Close()
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{"sorted by series", "test_card", http.StatusOK, "test_card_queue_size_lastmax 3\ntest_card_errors_total 2\ntest_card_state 1\n"},
+		{"longer prefix", "test_card_b", http.StatusOK, "test_card_b_state 1\n"},
+		{"unknown target", "test_unknown", http.StatusNotFound, "unknown target test_unknown\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(admin.URL + "/debug/cardinality?target=" + tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.status)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
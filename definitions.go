@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// counterDefinition documents a C5 counter in the exposed metadata
+type counterDefinition struct {
+	Description string
+	Unit        string
+}
+
+// Counter definitions by counter name, nil if not configured
+var (
+	counterDefinitionsMu sync.RWMutex
+	counterDefinitions   map[string]counterDefinition
+)
+
+func currentCounterDefinitions() map[string]counterDefinition {
+	counterDefinitionsMu.RLock()
+	defer counterDefinitionsMu.RUnlock()
+	return counterDefinitions
+}
+
+func setCounterDefinitions(defs map[string]counterDefinition) {
+	counterDefinitionsMu.Lock()
+	defer counterDefinitionsMu.Unlock()
+	counterDefinitions = defs
+}
+
+// parseCounterDefinitions reads CSV records of counter name, description and
+// an optional unit. Lines starting with # are ignored:
+//
+//	CALL_CONTROL_ACTIVE_CALLS,Currently active calls,calls
+func parseCounterDefinitions(r io.Reader) (map[string]counterDefinition, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	defs := map[string]counterDefinition{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return defs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name := strings.ToUpper(normalizeMetricName(record[0]))
+		if len(record) < 2 || len(record) > 3 || name == "" {
+			return nil, fmt.Errorf("invalid counter definition %q, expected name, description and optional unit", strings.Join(record, ","))
+		}
+		def := counterDefinition{Description: strings.TrimSpace(record[1])}
+		if len(record) == 3 {
+			def.Unit = strings.TrimSpace(record[2])
+		}
+		defs[name] = def
+	}
+}
+
+// loadCounterDefinitions reads the counter definitions from the given file
+func loadCounterDefinitions(path string) (map[string]counterDefinition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defs, err := parseCounterDefinitions(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return defs, nil
+}
+
+// reloadCounterDefinitions replaces the counter definitions, keeping the
+// previous ones if the file is invalid
+func reloadCounterDefinitions(path string) {
+	defs, err := loadCounterDefinitions(path)
+	if err != nil {
+		logError("Failed to reload counter definitions:", err)
+		return
+	}
+	setCounterDefinitions(defs)
+	logInfo("Reloaded", len(defs), "counter definitions from", path)
+}
+
+// Suffixes of the metrics exported per counter and their metric type
+var counterMetricSuffixes = []struct{ suffix, metricType string }{
+	{"_bytes_total", "counter"},
+	{"_total", "counter"},
+	{"_delta", "gauge"},
+	{"_current", "gauge"},
+	{"_lastmin", "gauge"},
+	{"_lastavg", "gauge"},
+	{"_lastmax", "gauge"},
+	{"_threshold", "gauge"},
+	{"_current_bytes", "gauge"},
+	{"_lastmin_bytes", "gauge"},
+	{"_lastavg_bytes", "gauge"},
+	{"_lastmax_bytes", "gauge"},
+}
+
+// counterMetadata returns the HELP and TYPE lines of a metric family exported
+// for a counter of one of the given prefixes. The counter is derived from the
+// source name, which differs from the family for renamed metrics. Counters
+// without definition get a generic description. Other families have no
+// metadata.
+func counterMetadata(family, source string, prefixes []string, defs map[string]counterDefinition) string {
+	prefix := longestPrefix(source, prefixes)
+	if prefix == "" {
+		return ""
+	}
+	for _, s := range counterMetricSuffixes {
+		if !strings.HasSuffix(source, s.suffix) || len(source) <= len(prefix)+1+len(s.suffix) {
+			continue
+		}
+		counter := strings.ToUpper(source[len(prefix)+1 : len(source)-len(s.suffix)])
+		help := "C5 counter " + counter + " of " + prefix
+		if def, ok := defs[counter]; ok {
+			help = def.Description
+			if def.Unit != "" {
+				help += " [" + def.Unit + "]"
+			}
+		}
+		help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+		return "# HELP " + family + " " + help + "\n# TYPE " + family + " " + s.metricType + "\n"
+	}
+	return ""
+}
+
+// addCounterMetadata adds HELP and TYPE lines to the counter metrics of the
+// Prometheus text exposition data. As metadata must precede all samples of
+// a family, samples are grouped by family in order of their first sample.
+// Families renamed using metricRenames are documented by the original name
+// given in renamed.
+func addCounterMetadata(data []byte, prefixes []string, defs map[string]counterDefinition, renamed map[string]string) []byte {
+	var families []string
+	samples := map[string]*bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		family := line
+		if n := strings.IndexAny(line, "{ "); n >= 0 && line != "" && line[0] != '#' {
+			family = line[:n]
+		}
+		buf, ok := samples[family]
+		if !ok {
+			buf = &bytes.Buffer{}
+			samples[family] = buf
+			families = append(families, family)
+			if line != "" && line[0] != '#' {
+				source := family
+				if name, ok := renamed[family]; ok {
+					source = name
+				}
+				buf.WriteString(counterMetadata(family, source, prefixes, defs))
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/2)
+	for _, family := range families {
+		out.Write(samples[family].Bytes())
+	}
+	return out.Bytes()
+}
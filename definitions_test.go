@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseCounterDefinitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]counterDefinition
+		wantErr bool
+	}{
+		{
+			"with units",
+			"# name,description,unit\nCALL_CONTROL_ACTIVE_CALLS, Currently active calls, calls\nsnmp_requests,SNMP requests received\n",
+			map[string]counterDefinition{
+				"CALL_CONTROL_ACTIVE_CALLS": {"Currently active calls", "calls"},
+				"SNMP_REQUESTS":             {"SNMP requests received", ""},
+			},
+			false,
+		},
+		{"quoted", `WS_CONNECTIONS,"Open websocket connections, all agents"`, map[string]counterDefinition{"WS_CONNECTIONS": {"Open websocket connections, all agents", ""}}, false},
+		{"missing description", "WS_CONNECTIONS\n", nil, true},
+		{"too many fields", "WS_CONNECTIONS,a,b,c\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCounterDefinitions(strings.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCounterDefinitions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCounterDefinitions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_addCounterMetadata(t *testing.T) {
+	defs := map[string]counterDefinition{"CALL_CONTROL_ACTIVE_CALLS": {"Currently active calls", "calls"}}
+	data := `c5_scrape_success{target="sipproxyd"} 1
+sipproxyd_call_control_active_calls_current 3
+sipproxyd_queue_size_lastmax 1
+sipproxyd_queue_size_lastmax_x_total 2
+sipproxyd_queue_size_lastmax{idx="0"} 3
+sipproxyd_state 1
+`
+	want := `c5_scrape_success{target="sipproxyd"} 1
+# HELP sipproxyd_call_control_active_calls_current Currently active calls [calls]
+# TYPE sipproxyd_call_control_active_calls_current gauge
+sipproxyd_call_control_active_calls_current 3
+# HELP sipproxyd_queue_size_lastmax C5 counter QUEUE_SIZE of sipproxyd
+# TYPE sipproxyd_queue_size_lastmax gauge
+sipproxyd_queue_size_lastmax 1
+sipproxyd_queue_size_lastmax{idx="0"} 3
+# HELP sipproxyd_queue_size_lastmax_x_total C5 counter QUEUE_SIZE_LASTMAX_X of sipproxyd
+# TYPE sipproxyd_queue_size_lastmax_x_total counter
+sipproxyd_queue_size_lastmax_x_total 2
+sipproxyd_state 1
+`
+	if got := string(addCounterMetadata([]byte(data), []string{"sipproxyd"}, defs, nil)); got != want {
+		t.Errorf("addCounterMetadata() = %s, want %s", got, want)
+	}
+}
+
+func Test_addCounterMetadataRenamed(t *testing.T) {
+	defs := map[string]counterDefinition{"CALL_CONTROL_ACTIVE_CALLS": {"Currently active calls", "calls"}}
+	data := `sipproxyd_active_calls 3
+`
+	want := `# HELP sipproxyd_active_calls Currently active calls [calls]
+# TYPE sipproxyd_active_calls gauge
+sipproxyd_active_calls 3
+`
+	renamed := map[string]string{"sipproxyd_active_calls": "sipproxyd_call_control_active_calls_current"}
+	if got := string(addCounterMetadata([]byte(data), []string{"sipproxyd"}, defs, renamed)); got != want {
+		t.Errorf("addCounterMetadata() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/communi5/prometheus-c5-exporter/config"
+	"github.com/prometheus/common/expfmt"
+)
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// addLabel adds the given label as first label to every sample of the
+// Prometheus text exposition data. Comment lines are kept as they are.
+func addLabel(data []byte, name, value string) []byte {
+	label := name + `="` + labelValueReplacer.Replace(value) + `"`
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/2)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			out.WriteString(line)
+			out.WriteByte('\n')
+			continue
+		}
+		out.WriteString(insertLabel(line, label))
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// insertLabel adds a label like `name="value"` as first label of a sample
+func insertLabel(line, label string) string {
+	n := strings.IndexAny(line, "{ ")
+	switch {
+	case n < 0:
+		return line
+	case strings.HasPrefix(line[n:], "{}"):
+		return line[:n] + "{" + label + line[n+1:]
+	case line[n] == '{':
+		return line[:n] + "{" + label + "," + line[n+1:]
+	}
+	return line[:n] + "{" + label + "}" + line[n:]
+}
+
+// longestPrefix returns the longest of the given target prefixes the metric
+// name of a sample starts with, or an empty string
+func longestPrefix(line string, prefixes []string) string {
+	match := ""
+	for _, prefix := range prefixes {
+		if len(prefix) > len(match) && strings.HasPrefix(line, prefix+"_") {
+			match = prefix
+		}
+	}
+	return match
+}
+
+// addNodeLabels adds a node label to the samples of each target, assigned by
+// the longest matching name prefix
+func addNodeLabels(data []byte, nodes map[string]string) []byte {
+	var prefixes []string
+	for prefix := range nodes {
+		prefixes = append(prefixes, prefix)
+	}
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/2)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && line[0] != '#' {
+			if prefix := longestPrefix(line, prefixes); prefix != "" {
+				line = insertLabel(line, `node="`+labelValueReplacer.Replace(nodes[prefix])+`"`)
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// addTimestamps appends the given timestamp in milliseconds to the samples of
+// each target, assigned by the longest matching name prefix. Other samples,
+// including the exporter metrics about the queries, are kept as they are, as
+// they change with every scrape.
+func addTimestamps(data []byte, times map[string]int64) []byte {
+	var prefixes []string
+	for prefix := range times {
+		prefixes = append(prefixes, prefix)
+	}
+	var out bytes.Buffer
+	out.Grow(len(data) + len(data)/4)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		out.WriteString(line)
+		if line != "" && line[0] != '#' {
+			if match := longestPrefix(line, prefixes); match != "" {
+				out.WriteString(" " + strconv.FormatInt(times[match], 10))
+			}
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// renameMetrics renames the samples of the given metrics. If keepOld is set
+// the samples are additionally kept under the old name, which allows
+// dashboards and alerts to migrate without gaps.
+func renameMetrics(data []byte, renames map[string]string, keepOld bool) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		n := strings.IndexAny(line, "{ ")
+		if line == "" || line[0] == '#' || n < 0 {
+			out.WriteString(line + "\n")
+			continue
+		}
+		newName, ok := renames[line[:n]]
+		if !ok || keepOld {
+			out.WriteString(line + "\n")
+		}
+		if ok {
+			out.WriteString(newName + line[n:] + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// writeMetrics writes all exporter and process metrics to w, adding sample
+// timestamps, renaming metrics, documenting counters and adding the node and
+// exporter_instance labels if configured.
+func writeMetrics(w io.Writer) {
+	conf := config.AppConfig
+	defs := currentCounterDefinitions()
+	if !conf.ExporterInstanceLabel && len(conf.MetricRenames) == 0 && !conf.SampleTimestamps && defs == nil && !conf.NodeLabel {
+		metricSet.WritePrometheus(w)
+		metrics.WriteProcessMetrics(w)
+		return
+	}
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	metrics.WriteProcessMetrics(&buf)
+	data := buf.Bytes()
+	if conf.SampleTimestamps {
+		data = addTimestamps(data, scrapeTimestamps())
+	}
+	if len(conf.MetricRenames) > 0 {
+		data = renameMetrics(data, conf.MetricRenames, conf.KeepOldMetricNames)
+	}
+	if defs != nil {
+		var prefixes []string
+		for _, t := range currentTargets() {
+			prefixes = append(prefixes, t.Prefix)
+		}
+		renamed := map[string]string{}
+		for name, newName := range conf.MetricRenames {
+			renamed[newName] = name
+		}
+		data = addCounterMetadata(data, prefixes, defs, renamed)
+	}
+	if conf.NodeLabel {
+		nodes := map[string]string{}
+		for _, t := range currentTargets() {
+			if node := targetNode(t); node != "" {
+				nodes[t.Prefix] = node
+			}
+		}
+		data = addNodeLabels(data, nodes)
+	}
+	if conf.ExporterInstanceLabel {
+		data = addLabel(data, "exporter_instance", conf.ExporterInstance)
+	}
+	w.Write(data)
+}
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// validateMetricRenames checks the configured metric names
+func validateMetricRenames(conf *config.AppConfiguration) error {
+	for oldName, newName := range conf.MetricRenames {
+		if !metricNameRegex.MatchString(oldName) || !metricNameRegex.MatchString(newName) {
+			return fmt.Errorf("invalid metric rename %q to %q", oldName, newName)
+		}
+	}
+	return nil
+}
+
+// sample is a single series of the Prometheus text exposition format
+type sample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  string            `json:"value"`
+}
+
+// parseSample parses a sample line like `name{label="value"} 1`
+func parseSample(line string) (s sample, err error) {
+	n := strings.IndexAny(line, "{ ")
+	if n <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.Name = line[:n]
+	rest := line[n:]
+	if rest[0] == '{' {
+		s.Labels = map[string]string{}
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			eq := strings.Index(rest, `="`)
+			if eq <= 0 {
+				return s, fmt.Errorf("invalid labels in sample %q", line)
+			}
+			name := rest[:eq]
+			var value strings.Builder
+			i := eq + 2
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+					if rest[i] == 'n' {
+						value.WriteByte('\n')
+						continue
+					}
+				}
+				value.WriteByte(rest[i])
+			}
+			if i >= len(rest) {
+				return s, fmt.Errorf("unterminated label value in sample %q", line)
+			}
+			s.Labels[name] = value.String()
+			rest = strings.TrimPrefix(rest[i+1:], ",")
+		}
+		rest = rest[1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value in sample %q", line)
+	}
+	s.Value = fields[0]
+	return s, nil
+}
+
+// writeJSONMetrics converts the Prometheus text exposition data to a JSON
+// list of samples. Values are kept as strings like in the Prometheus API,
+// as JSON doesn't support NaN and infinite numbers.
+func writeJSONMetrics(w io.Writer, data []byte) error {
+	list := []sample{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return err
+		}
+		list = append(list, s)
+	}
+	return json.NewEncoder(w).Encode(list)
+}
+
+// validateExposition checks the Prometheus text exposition data for errors
+// which would make Prometheus reject the whole scrape, like invalid names,
+// values or duplicate metadata, using the parser of Prometheus itself.
+func validateExposition(data []byte) error {
+	var parser expfmt.TextParser
+	_, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	return err
+}
+
+// runOutputValidation periodically validates the exposed metrics, so output
+// corrupted e.g. by an unescaped label value is detected before Prometheus
+// rejects the whole scrape. The current metrics are rendered without
+// querying the C5 processes.
+func runOutputValidation(interval time.Duration) {
+	logInfo("Validating the exposed metrics every", interval)
+	for range time.Tick(interval) {
+		validateOutput()
+	}
+}
+
+// validateOutput validates the response of the /metrics handler once, as
+// received by Prometheus requesting compression, exposing the result as
+// c5_self_metrics_valid
+func validateOutput() bool {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	serveMetrics(rec, req)
+	err := validateResponse(rec.Result())
+	if err != nil {
+		logError("Invalid metrics output:", err)
+	}
+	setParseSuccess(`c5_self_metrics_valid`, err == nil)
+	return err == nil
+}
+
+// validateResponse validates the exposition data of the /metrics response,
+// decompressing it if needed.
+func validateResponse(resp *http.Response) error {
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return validateExposition(data)
+}
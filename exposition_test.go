@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+func Test_addLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		value string
+		want  string
+	}{
+		{"no labels", "sipproxyd_state 1\n", "node1", "sipproxyd_state{exporter_instance=\"node1\"} 1\n"},
+		{"labels", "sipproxyd_info{version=\"6.0.2.57\"} 1\n", "node1", "sipproxyd_info{exporter_instance=\"node1\",version=\"6.0.2.57\"} 1\n"},
+		{"empty labels", "sipproxyd_state{} 1\n", "node1", "sipproxyd_state{exporter_instance=\"node1\"} 1\n"},
+		{"comment", "# HELP go_goroutines\ngo_goroutines 7\n", "node1", "# HELP go_goroutines\ngo_goroutines{exporter_instance=\"node1\"} 7\n"},
+		{"escaped value", "sipproxyd_state 1\n", `a"b\c`, "sipproxyd_state{exporter_instance=\"a\\\"b\\\\c\"} 1\n"},
+		{"label value with blank", "sipproxyd_info{version=\"6 0\"} 1\n", "node1", "sipproxyd_info{exporter_instance=\"node1\",version=\"6 0\"} 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(addLabel([]byte(tt.data), "exporter_instance", tt.value)); got != tt.want {
+				t.Errorf("addLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSample(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    sample
+		wantErr bool
+	}{
+		{"no labels", "sipproxyd_state 1", sample{Name: "sipproxyd_state", Value: "1"}, false},
+		{"labels", `sipproxyd_info{version="6.0.2.57",starttime="2020-01-19 04:01:04.503"} 1`,
+			sample{Name: "sipproxyd_info", Labels: map[string]string{"version": "6.0.2.57", "starttime": "2020-01-19 04:01:04.503"}, Value: "1"}, false},
+		{"escaped", `c5_x{a="q\"b\\c\nd",b="}"} 2.5`, sample{Name: "c5_x", Labels: map[string]string{"a": "q\"b\\c\nd", "b": "}"}, Value: "2.5"}, false},
+		{"empty labels", "c5_x{} NaN", sample{Name: "c5_x", Labels: map[string]string{}, Value: "NaN"}, false},
+		{"missing value", "c5_x", sample{}, true},
+		{"unterminated", `c5_x{a="b} 1`, sample{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSample(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSample() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeJSONMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	data := "# comment\nsipproxyd_state 1\nsipproxyd_info{version=\"6.0.2.57\"} 1\n"
+	if err := writeJSONMetrics(&buf, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"name":"sipproxyd_state","value":"1"},{"name":"sipproxyd_info","labels":{"version":"6.0.2.57"},"value":"1"}]` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("writeJSONMetrics() = %v, want %v", got, want)
+	}
+}
+
+func Test_writeJSONMetricsProcessMetrics(t *testing.T) {
+	var data, buf bytes.Buffer
+	writeMetrics(&data)
+	if err := writeJSONMetrics(&buf, data.Bytes()); err != nil {
+		t.Errorf("writeJSONMetrics() error = %v", err)
+	}
+}
+
+func Test_validateExposition(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"valid", "# HELP sipproxyd_state State\n# TYPE sipproxyd_state gauge\nsipproxyd_state 1\nsipproxyd_info{version=\"6.0.2.57\",node=\"c5\"} 1 1600000000000\nc5_ratio NaN\n", ""},
+		{"invalid metric name", "sipproxyd-state 1\n", "line 1: expected float as value"},
+		{"invalid label name", "sipproxyd_info{idx-no=\"1\"} 1\n", "expected '=' after label name"},
+		{"unescaped quote", "sipproxyd_info{version=\"6.0\"x\"} 1\n", "unexpected end of label value"},
+		{"invalid value", "sipproxyd_state one\n", "expected float as value, got \"one\""},
+		{"invalid timestamp", "sipproxyd_state 1 now\n", "expected integer as timestamp"},
+		{"duplicate type", "# TYPE sipproxyd_state gauge\n# TYPE sipproxyd_state counter\n", "second TYPE"},
+		{"type after samples", "sipproxyd_state 1\n# TYPE sipproxyd_state gauge\n", "line 2: second TYPE line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExposition([]byte(tt.data))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateExposition() error = %v", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateExposition() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateOutput(t *testing.T) {
+	if !validateOutput() {
+		t.Error("validateOutput() = false for the exposed metrics")
+	}
+	if got := metricSet.GetOrCreateCounter(`c5_self_metrics_valid`).Get(); got != 1 {
+		t.Errorf("c5_self_metrics_valid = %v, want 1", got)
+	}
+}
+
+func Test_renameMetrics(t *testing.T) {
+	data := "# comment\nsipproxyd_state 1\nsipproxyd_info{version=\"6.0.2.57\"} 1\nsipproxyd_info_x 2\n"
+	renames := map[string]string{"sipproxyd_state": "sipproxyd_up", "sipproxyd_info": "sipproxyd_build_info"}
+	tests := []struct {
+		name    string
+		keepOld bool
+		want    string
+	}{
+		{"renamed", false, "# comment\nsipproxyd_up 1\nsipproxyd_build_info{version=\"6.0.2.57\"} 1\nsipproxyd_info_x 2\n"},
+		{"keep old", true, "# comment\nsipproxyd_state 1\nsipproxyd_up 1\nsipproxyd_info{version=\"6.0.2.57\"} 1\nsipproxyd_build_info{version=\"6.0.2.57\"} 1\nsipproxyd_info_x 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(renameMetrics([]byte(data), renames, tt.keepOld)); got != tt.want {
+				t.Errorf("renameMetrics() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeMetricsRenamedMetadata(t *testing.T) {
+	defer setTargets(currentTargets())
+	defer setCounterDefinitions(currentCounterDefinitions())
+	defer func() { config.AppConfig.MetricRenames = nil }()
+	defer clearMetrics("test_meta")
+	setTargets([]config.Target{{Prefix: "test_meta", URL: "http://localhost:9980/"}})
+	setCounterDefinitions(map[string]counterDefinition{"CALL_CONTROL_ACTIVE_CALLS": {"Currently active calls", "calls"}})
+	config.AppConfig.MetricRenames = map[string]string{"test_meta_call_control_active_calls_current": "test_meta_active_calls"}
+	metricSet.GetOrCreateCounter("test_meta_call_control_active_calls_current").Set(3)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	want := "# HELP test_meta_active_calls Currently active calls [calls]\n# TYPE test_meta_active_calls gauge\ntest_meta_active_calls 3\n"
+	if got := buf.String(); !strings.Contains(got, want) {
+		t.Errorf("writeMetrics() missing %q in %s", want, got)
+	}
+}
+
+func Test_addTimestamps(t *testing.T) {
+	times := map[string]int64{"sipproxyd": 1000, "node2_sipproxyd": 2000}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"# comment", "# comment"},
+		{"sipproxyd_state 1", "sipproxyd_state 1 1000"},
+		{`node2_sipproxyd_info{version="6.0.2.57"} 1`, `node2_sipproxyd_info{version="6.0.2.57"} 1 2000`},
+		{`c5_scrape_success{target="sipproxyd"} 1`, `c5_scrape_success{target="sipproxyd"} 1`},
+		{"registrard_state 1", "registrard_state 1"},
+		{"process_cpu_seconds_total 3", "process_cpu_seconds_total 3"},
+	}
+	for _, tt := range tests {
+		if got := string(addTimestamps([]byte(tt.line+"\n"), times)); got != tt.want+"\n" {
+			t.Errorf("addTimestamps(%q) = %q, want %q", tt.line, got, tt.want+"\n")
+		}
+	}
+}
+
+func Test_addNodeLabels(t *testing.T) {
+	nodes := map[string]string{"sipproxyd": "c5-node1", "node2_sipproxyd": "c5-node2"}
+	data := "# comment\nsipproxyd_state 1\nnode2_sipproxyd_info{version=\"6.0.2.57\"} 1\nc5_scrape_success{target=\"sipproxyd\"} 1\n"
+	want := "# comment\nsipproxyd_state{node=\"c5-node1\"} 1\nnode2_sipproxyd_info{node=\"c5-node2\",version=\"6.0.2.57\"} 1\nc5_scrape_success{target=\"sipproxyd\"} 1\n"
+	if got := string(addNodeLabels([]byte(data), nodes)); got != want {
+		t.Errorf("addNodeLabels() = %q, want %q", got, want)
+	}
+}
@@ -1,8 +1,9 @@
 module github.com/communi5/prometheus-c5-exporter
 
-go 1.15
+go 1.16
 
 require (
 	github.com/VictoriaMetrics/metrics v1.17.2
 	github.com/jinzhu/configor v1.2.1
+	github.com/prometheus/common v0.32.1
 )
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+var (
+	influxMeasurementReplacer = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagReplacer         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+// influxLines converts the Prometheus text exposition data to the InfluxDB
+// line protocol. Metrics of a target are written as measurement without the
+// prefix and a target tag, e.g. sipproxyd_state becomes state,target=sipproxyd.
+// Samples with non-finite values are skipped.
+func influxLines(data []byte, prefixes []string, ts time.Time) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(s.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in sample %q", line)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		tags := map[string]string{}
+		for k, v := range s.Labels {
+			tags[k] = v
+		}
+		measurement := s.Name
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(s.Name, prefix+"_") {
+				measurement = strings.TrimPrefix(s.Name, prefix+"_")
+				tags["target"] = prefix
+				break
+			}
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out.WriteString(influxMeasurementReplacer.Replace(measurement))
+		for _, k := range keys {
+			if tags[k] == "" {
+				continue
+			}
+			out.WriteString("," + influxTagReplacer.Replace(k) + "=" + influxTagReplacer.Replace(tags[k]))
+		}
+		out.WriteString(" value=" + strconv.FormatFloat(value, 'g', -1, 64) + " " + strconv.FormatInt(ts.UnixNano(), 10) + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+// pushInflux writes the current metrics to the InfluxDB write endpoint. The
+// processes are not queried again, which would move the _delta baselines and
+// the throttling of the Prometheus scrapes.
+func pushInflux(ctx context.Context, url string) error {
+	var buf bytes.Buffer
+	metricSet.WritePrometheus(&buf)
+	var prefixes []string
+	for _, t := range currentTargets() {
+		prefixes = append(prefixes, t.Prefix)
+	}
+	// Longer prefixes first, so e.g. node1_sipproxyd wins over node1
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	lines, err := influxLines(buf.Bytes(), prefixes, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// runInfluxPush periodically pushes the metrics to InfluxDB, independent of
+// the Prometheus scrapes
+func runInfluxPush(conf *config.AppConfiguration) {
+	logInfo("Pushing metrics to InfluxDB", conf.InfluxURL, "every", conf.InfluxInterval)
+	for range time.Tick(conf.InfluxInterval.Duration) {
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout.Duration)
+		if err := pushInflux(ctx, conf.InfluxURL); err != nil {
+			logError("Failed to push metrics to InfluxDB:", err)
+			getCounter(`c5_influx_push_errors_total`).Inc()
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+func Test_influxLines(t *testing.T) {
+	ts := time.Unix(1614247908, 0)
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"target metric", "sipproxyd_state 1\n", "state,target=sipproxyd value=1 1614247908000000000\n"},
+		{"labels", `sipproxyd_info{version="6.0.2.57",starttime="2020-01-19 04:01:04.503"} 1` + "\n",
+			`info,starttime=2020-01-19\ 04:01:04.503,target=sipproxyd,version=6.0.2.57 value=1 1614247908000000000` + "\n"},
+		{"internal metric", `c5_scrape_errors_total{target="sipproxyd",reason="dns"} 2` + "\n",
+			"c5_scrape_errors_total,reason=dns,target=sipproxyd value=2 1614247908000000000\n"},
+		{"longest prefix", "node1_sipproxyd_state 1\n", "state,target=node1_sipproxyd value=1 1614247908000000000\n"},
+		{"escaped", `c5_x{a="b,c=d"} 0.5` + "\n", `c5_x,a=b\,c\=d value=0.5 1614247908000000000` + "\n"},
+		{"non-finite", "c5_x NaN\nc5_y +Inf\n", ""},
+		{"comment", "# TYPE c5_x gauge\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := influxLines([]byte(tt.data), []string{"node1_sipproxyd", "sipproxyd"}, ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("influxLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pushInflux(t *testing.T) {
+	var queries int64
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&queries, 1)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	var body string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_influx", URL: c5.URL}})
+	defer clearMetrics("test_influx")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_influx", URL: c5.URL}, &wg)
+
+	if err := pushInflux(context.Background(), influx.URL+"/write?db=c5"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&queries); got != 1 {
+		t.Errorf("C5 queries = %v, want only the scrape before pushInflux()", got)
+	}
+	if !strings.Contains(body, "\ntransport_message_in_total,target=test_influx value=6502 ") {
+		t.Errorf("pushInflux() body misses transport_message_in_total of test_influx:\n%s", body)
+	}
+}
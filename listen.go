@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Time granted to running requests when the listeners are shut down
+const shutdownTimeout = 5 * time.Second
+
+// parseListenAddresses splits a comma separated list of listen addresses
+// like ":9055,[::1]:9055", checking each of them
+func parseListenAddresses(list string) ([]string, error) {
+	var addrs []string
+	seen := map[string]bool{}
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			return nil, fmt.Errorf("empty listen address in %q", list)
+		} else if seen[addr] {
+			return nil, fmt.Errorf("duplicate listen address %s", addr)
+		}
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address %s: %v", addr, err)
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// listenAll opens a listener for each address. If one fails, the listeners
+// opened before are closed again, so the exporter never runs on only part of
+// the configured addresses.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// serveAll serves the handler on all listeners until ctx is done or one of
+// them fails, then shuts down all servers gracefully. It returns the error of
+// the failed server, if any.
+func serveAll(ctx context.Context, listeners []net.Listener, handler http.Handler) error {
+	servers := make([]*http.Server, len(listeners))
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		servers[i] = &http.Server{Handler: handler}
+		go func(srv *http.Server, l net.Listener) {
+			errs <- srv.Serve(l)
+		}(servers[i], l)
+	}
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		logError("Listener failed, stopping all listeners:", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logError("Failed to shut down listener gracefully:", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseListenAddresses(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{":9055", []string{":9055"}, false},
+		{"127.0.0.1:9055, [::1]:9055", []string{"127.0.0.1:9055", "[::1]:9055"}, false},
+		{"127.0.0.1:9055,", nil, true},
+		{"127.0.0.1:9055,127.0.0.1:9055", nil, true},
+		{"127.0.0.1", nil, true},
+		{"127.0.0.1:http-exporter", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseListenAddresses(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseListenAddresses(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListenAddresses(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func Test_listenAll(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	if _, err := listenAll([]string{freeAddr, used.Addr().String()}); err == nil {
+		t.Fatal("listenAll() with used address succeeded")
+	}
+	// The listener opened before the failure must have been closed again
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("listenAll() kept %s open: %v", freeAddr, err)
+	}
+	l.Close()
+}
+
+func Test_serveAll(t *testing.T) {
+	listeners, err := listenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- serveAll(ctx, listeners, handler) }()
+
+	client := http.Client{Timeout: time.Second}
+	for _, l := range listeners {
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("serveAll() not serving on %s: %v", l.Addr(), err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("serveAll() on %s = %q, want ok", l.Addr(), body)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveAll() = %v, want nil after shutdown", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatal("serveAll() did not return after shutdown")
+	}
+	for _, l := range listeners {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+			t.Errorf("serveAll() still listening on %s after shutdown", l.Addr())
+		}
+	}
+}
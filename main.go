@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/communi5/prometheus-c5-exporter/config"
-	"github.com/jinzhu/configor"
 )
 
 const version = "1.1.1"
@@ -25,37 +38,233 @@ const version = "1.1.1"
 // Global metric set
 var metricSet *metrics.Set
 
+// Private metric sets of targets queried without exposing their metrics, like
+// by /debug/delta, by target prefix
+var (
+	privateSetsMu sync.RWMutex
+	privateSets   = map[string]*metrics.Set{}
+)
+
+// setFor returns the set of the given series, the private set of its target
+// if any, otherwise the global metric set
+func setFor(name string) *metrics.Set {
+	privateSetsMu.RLock()
+	defer privateSetsMu.RUnlock()
+	for prefix, set := range privateSets {
+		if strings.HasPrefix(name, prefix) || strings.HasPrefix(name, "c5_"+prefix) || strings.Contains(name, `target="`+prefix) {
+			return set
+		}
+	}
+	return metricSet
+}
+
+// getCounter returns the counter of the given series, registering it in the
+// set returned by setFor if needed
+func getCounter(name string) *metrics.Counter {
+	return setFor(name).GetOrCreateCounter(name)
+}
+
+// unregisterMetric removes the given series from the set returned by setFor
+func unregisterMetric(name string) {
+	setFor(name).UnregisterMetric(name)
+}
+
+// getFloatCounter returns the float counter of the given series, registering
+// it in the set returned by setFor if needed
+func getFloatCounter(name string) *metrics.FloatCounter {
+	return setFor(name).GetOrCreateFloatCounter(name)
+}
+
+// Shared HTTP transport for all C5 queries
+var c5Transport *http.Transport
+
 type eventCounter struct {
-	ID    string
-	Name  string
-	Idx   *int
-	Total uint64
+	ID      string
+	Name    string
+	Section string // Name of the section listing the counter, if enabled
+	Idx     *int
+	Total   uint64
+	Invalid int // Number of values which could not be parsed
 }
 
 type usageCounter struct {
 	ID      string
 	Name    string
+	Section string // Name of the section listing the counter, if enabled
 	Idx     *int
 	Current uint64
 	LastMin uint64
 	LastAvg uint64
 	LastMax uint64
+	Invalid int  // Number of values which could not be parsed
+	Bytes   bool // Values were reported with data size units like "57MB"
 }
 
 type c5StateResponse struct {
-	ProxyState              string        // "proxyState" : "active", // sipproxyd only
-	QueueState              string        // "queueState" : "active", // acdqueued only
-	RegistrarState          string        // "registrarState" : "active", // registar only
-	NotificationServerState string        // "notificationServerState" : "active", // notification server only
-	CstaState               string        // "cstaState" : "active", //cstagw only
-	BuildVersion            string        // "buildVersion": "Version: 6.0.2.57, compiled on Jan 15 2020, 13:06:31 built by TELES Communication Systems GmbH",
-	BuildVersionOld         string        `json:"buildVersion:"` // Workaround for typo in "buildVersion:" (trailing colon) before R6.2
-	StartupTime             string        // "startupTime" : "2020-01-19 04:01:04.503",
-	StartupTimeOld          string        `json:"startupTime:"` // Workaround for typo in "startupTime:" (trailing colon) before R6.2
-	MemoryUsage             string        // "memoryUsage" : "C5 Heap Health: OK  - Mem used: 2%  - Mem used: 57MB  - Mem total: 2048MB  - Max: 3% - UpdCtr: 13198",
-	TuQueueStatus           string        // "tuQueueStatus" : "OK - checked: 1830",
-	CounterInfos            []interface{} // "counterInfos": [ ... ]
-	AlarmedTrapInfos        []interface{} // "alarmedTrapInfos": [ ... ]
+	ProxyState              string            // "proxyState" : "active", // sipproxyd only
+	QueueState              string            // "queueState" : "active", // acdqueued only
+	RegistrarState          string            // "registrarState" : "active", // registar only
+	NotificationServerState string            // "notificationServerState" : "active", // notification server only
+	CstaState               string            // "cstaState" : "active", //cstagw only
+	BuildVersion            string            // "buildVersion": "Version: 6.0.2.57, compiled on Jan 15 2020, 13:06:31 built by TELES Communication Systems GmbH",
+	BuildVersionOld         string            `json:"buildVersion:"` // Workaround for typo in "buildVersion:" (trailing colon) before R6.2
+	StartupTime             string            // "startupTime" : "2020-01-19 04:01:04.503",
+	StartupTimeOld          string            `json:"startupTime:"` // Workaround for typo in "startupTime:" (trailing colon) before R6.2
+	MemoryUsage             string            // "memoryUsage" : "C5 Heap Health: OK  - Mem used: 2%  - Mem used: 57MB  - Mem total: 2048MB  - Max: 3% - UpdCtr: 13198",
+	TuQueueStatus           string            // "tuQueueStatus" : "OK - checked: 1830",
+	CounterInfos            []json.RawMessage // "counterInfos": [ ... ]
+	AlarmedTrapInfos        []interface{}     // "alarmedTrapInfos": [ ... ]
+}
+
+// State field expected per type of C5 process
+var daemonStateFields = map[string]string{
+	"sipproxyd":    "proxyState",
+	"acdqueued":    "queueState",
+	"registrard":   "registrarState",
+	"notification": "notificationServerState",
+	"cstagwd":      "cstaState",
+}
+
+// JSON keys of the state response fields, which may be renamed per type of
+// C5 process using responseKeys
+var stateResponseKeys = []string{
+	"proxyState", "queueState", "registrarState", "notificationServerState", "cstaState",
+	"buildVersion", "buildVersion:", "startupTime", "startupTime:",
+	"memoryUsage", "tuQueueStatus", "counterInfos", "alarmedTrapInfos",
+}
+
+// responseKeys returns the configured JSON keys by state response field of
+// the given type of C5 process. Keys configured for "*" apply to all types.
+func responseKeys(daemon string) map[string]string {
+	all, own := config.AppConfig.ResponseKeys["*"], config.AppConfig.ResponseKeys[daemon]
+	if daemon == "" || len(own) == 0 {
+		return all
+	}
+	keys := map[string]string{}
+	for field, key := range all {
+		keys[field] = key
+	}
+	for field, key := range own {
+		keys[field] = key
+	}
+	return keys
+}
+
+// validateResponseKeys checks the response keys are configured for known
+// types of C5 processes and state response fields
+func validateResponseKeys(responseKeys map[string]map[string]string) error {
+	for daemon, keys := range responseKeys {
+		if _, ok := daemonStateFields[daemon]; !ok && daemon != "*" {
+			return fmt.Errorf("unknown daemon %q of responseKeys", daemon)
+		}
+		for field, key := range keys {
+			known := false
+			for _, k := range stateResponseKeys {
+				known = known || k == field
+			}
+			if !known || key == "" {
+				return fmt.Errorf("invalid responseKeys field %q = %q of %s", field, key, daemon)
+			}
+		}
+	}
+	return nil
+}
+
+// keyedStateResponse decodes a state response using other JSON keys than
+// the struct tags of c5StateResponse, e.g. if a C5 release renamed a field
+type keyedStateResponse struct {
+	state *c5StateResponse
+	keys  map[string]string // JSON key by field
+}
+
+// UnmarshalJSON decodes each field of the state response from its configured
+// key. Configured keys take precedence over fields still using the default
+// key, which is matched case-insensitively like encoding/json does.
+func (k *keyedStateResponse) UnmarshalJSON(data []byte) error {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	// Keys configured for another field don't match by default key
+	renamed := map[string]bool{}
+	for field, key := range k.keys {
+		if _, ok := values[key]; ok && key != field {
+			renamed[key] = true
+		}
+	}
+	for field, ptr := range k.state.fields() {
+		key := k.keys[field]
+		value, ok := values[key]
+		if !ok || key == "" {
+			key, value, ok = defaultKeyValue(values, field, renamed)
+		}
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, ptr); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// defaultKeyValue returns the value of the default key of a field, preferring
+// an exact match over a case-insensitive one
+func defaultKeyValue(values map[string]json.RawMessage, field string, renamed map[string]bool) (string, json.RawMessage, bool) {
+	if value, ok := values[field]; ok && !renamed[field] {
+		return field, value, true
+	}
+	for key, value := range values {
+		if strings.EqualFold(key, field) && !renamed[key] {
+			return key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+// fields returns pointers to the fields of the state response by their
+// default JSON key, as listed in stateResponseKeys
+func (state *c5StateResponse) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"proxyState":              &state.ProxyState,
+		"queueState":              &state.QueueState,
+		"registrarState":          &state.RegistrarState,
+		"notificationServerState": &state.NotificationServerState,
+		"cstaState":               &state.CstaState,
+		"buildVersion":            &state.BuildVersion,
+		"buildVersion:":           &state.BuildVersionOld,
+		"startupTime":             &state.StartupTime,
+		"startupTime:":            &state.StartupTimeOld,
+		"memoryUsage":             &state.MemoryUsage,
+		"tuQueueStatus":           &state.TuQueueStatus,
+		"counterInfos":            &state.CounterInfos,
+		"alarmedTrapInfos":        &state.AlarmedTrapInfos,
+	}
+}
+
+// processStates returns the state fields of the given type of C5 process,
+// or all state fields if the type is not configured
+func (state c5StateResponse) processStates(daemon string) []string {
+	switch daemon {
+	case "sipproxyd":
+		return []string{state.ProxyState}
+	case "acdqueued":
+		return []string{state.QueueState}
+	case "registrard":
+		return []string{state.RegistrarState}
+	case "notification":
+		return []string{state.NotificationServerState}
+	case "cstagwd":
+		return []string{state.CstaState}
+	}
+	return []string{state.ProxyState, state.QueueState, state.RegistrarState, state.NotificationServerState, state.CstaState}
+}
+
+func (state c5StateResponse) startupTime() string {
+	if state.StartupTime == "" { // Workaround for typo in sessionconsole before R6.2
+		return state.StartupTimeOld
+	}
+	return state.StartupTime
 }
 
 type c5CounterResponse struct {
@@ -74,103 +283,465 @@ type c5CounterResponse struct {
 	TableValues                    []interface{} // "counterInfos": [ ... ]
 }
 
-func buildMetricName(prefix string, name string, idx *int) string {
+// buildMetricName returns the metric name of a counter of the given section
+// of the response. Depending on counterSections the section is added to the
+// name or as label.
+func buildMetricName(prefix, section, name string, idx *int) string {
+	if section != "" && config.AppConfig.CounterSections == "name" {
+		name = section + "_" + name
+	}
 	if prefix != "" {
 		name = prefix + "_" + name
 	}
-	name = strings.ToLower(name)
+	name = metricNameCase(name)
+	var labels []string
+	if section != "" && config.AppConfig.CounterSections == "label" {
+		labels = append(labels, `section="`+metricNameCase(section)+`"`)
+	}
 	if idx != nil {
-		return fmt.Sprintf(`%s{idx="%d"}`, name, *idx)
+		labels = append(labels, fmt.Sprintf(`%s="%d"`, idxLabel(), *idx))
+	}
+	if len(labels) > 0 {
+		name += "{" + strings.Join(labels, ",") + "}"
 	}
 	return name
 }
 
+// Non-counter lines naming a section of a counter table, like "  Transport"
+var counterSectionRegex = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z0-9_]*(?: +[A-Za-z0-9_]+)*)\s*:?\s*$`)
+
+// counterSection returns the name of the section started by the given line,
+// e.g. "Transport_Layer" for "  Transport Layer:", otherwise an empty string
+func counterSection(line string) string {
+	m := counterSectionRegex.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(m[1]), "_")
+}
+
+// Characters not allowed in metric names
+var invalidMetricNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// metricNameCase lowercases a metric name, including labels like the trunk
+// names, unless the case of the C5 counter names is preserved. Invalid
+// characters of the name are replaced by underscores in both modes.
+func metricNameCase(name string) string {
+	if !config.AppConfig.PreserveCounterCase {
+		name = strings.ToLower(name)
+	}
+	labels := ""
+	if n := strings.IndexByte(name, '{'); n >= 0 {
+		name, labels = name[:n], name[n:]
+	}
+	return invalidMetricNameRegex.ReplaceAllString(name, "_") + labels
+}
+
+// idxLabel returns the label key of the line index of multi-line counters
+func idxLabel() string {
+	if config.AppConfig.IdxLabel != "" {
+		return config.AppConfig.IdxLabel
+	}
+	return "idx"
+}
+
 func normalizeMetricName(name string) string {
 	// Avoid unwanted trailing chars like in
 	// v6.0.2.69: TRANSACTION_AND_TU_TU_MANAGER_REINJECT_QUEUE_
 	return strings.Trim(name, "_. ")
 }
 
+// validateCounterTypes checks and normalizes the configured counter type
+// overrides. Counters unknown from the embedded samples are rejected, like
+// invalid targets, as a typo would silently keep the misclassified type.
+func validateCounterTypes(conf *config.AppConfiguration) error {
+	known := knownCounterNames()
+	types := map[string]string{}
+	for name, typ := range conf.CounterTypes {
+		name = strings.ToUpper(name)
+		typ = strings.ToLower(typ)
+		if typ != "counter" && typ != "gauge" {
+			return fmt.Errorf("invalid type %q for counter %s, must be counter or gauge", typ, name)
+		}
+		if !known[name] {
+			return fmt.Errorf("type override for unknown counter %s", name)
+		}
+		types[name] = typ
+	}
+	conf.CounterTypes = types
+	return nil
+}
+
+// usageSuffix returns the metric name suffix of a usage counter value, with
+// the unit added for values reported as data sizes
+func usageSuffix(suffix string, bytes bool) string {
+	if !bytes {
+		return suffix
+	} else if suffix == "_total" {
+		return "_bytes_total"
+	}
+	return suffix + "_bytes"
+}
+
+// Keys like "sipproxyd_TRANSPORT_BUFFER_USAGE" of the usage counters reported
+// in bytes
+var (
+	byteCountersMu sync.Mutex
+	byteCounters   = map[string]bool{}
+)
+
+// setByteUnit decides the unit of the lines of a usage counter by its name.
+// Once a value was reported with data size unit, all values of the counter
+// are taken as bytes for good, including those without unit, so its series
+// don't switch names between lines and scrapes. It returns true if the
+// counter was just switched to bytes, making its series without unit stale.
+func setByteUnit(prefix string, cnts []usageCounter) bool {
+	if len(cnts) == 0 {
+		return false
+	}
+	key := prefix + "_" + cnts[0].Name
+	bytes := false
+	for _, c := range cnts {
+		bytes = bytes || c.Bytes
+	}
+	byteCountersMu.Lock()
+	changed := bytes && !byteCounters[key]
+	if changed {
+		byteCounters[key] = true
+	}
+	bytes = byteCounters[key]
+	byteCountersMu.Unlock()
+	for i := range cnts {
+		cnts[i].Bytes = bytes
+	}
+	if changed {
+		logInfo("Usage counter", key, "reported in bytes")
+	}
+	return changed
+}
+
+// Suffixes of the series of a usage counter
+var usageSuffixes = []string{"_total", "_current", "_lastmin", "_lastavg", "_lastmax"}
+
+// clearUnitlessUsage removes the series without unit of a usage counter
+// switched to bytes, of all its lines and sections
+func clearUnitlessUsage(prefix string, c usageCounter) {
+	for _, suffix := range usageSuffixes {
+		name := buildMetricName(prefix, c.Section, c.Name+suffix, nil)
+		unregisterSeries(strings.SplitN(name, "{", 2)[0])
+	}
+}
+
+// forgetByteCounters drops the units of the usage counters with the given
+// prefix, once their series have been unregistered
+func forgetByteCounters(prefix string) {
+	byteCountersMu.Lock()
+	defer byteCountersMu.Unlock()
+	for key := range byteCounters {
+		if strings.HasPrefix(key, prefix) {
+			delete(byteCounters, key)
+		}
+	}
+}
+
 func setUsageMetric(prefix string, metric usageCounter) {
 	// logDebug("set usage metric for ", prefix, metric.Name)
-	current := buildMetricName(prefix, metric.Name+"_current", metric.Idx)
+	if config.AppConfig.CounterTypes[metric.Name] == "counter" {
+		total := buildMetricName(prefix, metric.Section, metric.Name+usageSuffix("_total", metric.Bytes), metric.Idx)
+		setMetricValue(total, metric.Current)
+		if !config.AppConfig.KeepOldCounterTypes {
+			return
+		}
+	}
+	current := buildMetricName(prefix, metric.Section, metric.Name+usageSuffix("_current", metric.Bytes), metric.Idx)
 	setMetricValue(current, metric.Current)
-	lastMin := buildMetricName(prefix, metric.Name+"_lastmin", metric.Idx)
+	lastMin := buildMetricName(prefix, metric.Section, metric.Name+usageSuffix("_lastmin", metric.Bytes), metric.Idx)
 	setMetricValue(lastMin, metric.LastMin)
-	lastAvg := buildMetricName(prefix, metric.Name+"_lastavg", metric.Idx)
+	lastAvg := buildMetricName(prefix, metric.Section, metric.Name+usageSuffix("_lastavg", metric.Bytes), metric.Idx)
 	setMetricValue(lastAvg, metric.LastAvg)
-	lastMax := buildMetricName(prefix, metric.Name+"_lastmax", metric.Idx)
+	lastMax := buildMetricName(prefix, metric.Section, metric.Name+usageSuffix("_lastmax", metric.Bytes), metric.Idx)
 	setMetricValue(lastMax, metric.LastMax)
 }
 
+// setSubUsageSum exports the sum of the current values of all lines of a
+// multi-line usage counter as series without index, if enabled
+func setSubUsageSum(prefix string, cnts []usageCounter) {
+	if !config.AppConfig.SumSubUsageCounters || len(cnts) == 0 {
+		return
+	}
+	var sum uint64
+	bytes := false
+	for _, c := range cnts {
+		bytes = bytes || c.Bytes
+		if sum+c.Current < sum {
+			sum = math.MaxUint64
+			break
+		}
+		sum += c.Current
+	}
+	suffix := "_current"
+	if config.AppConfig.CounterTypes[cnts[0].Name] == "counter" {
+		suffix = "_total"
+	}
+	setMetricValue(buildMetricName(prefix, cnts[0].Section, cnts[0].Name+usageSuffix(suffix, bytes), nil), sum)
+}
+
+// Usage counters of acdqueued reporting the depth of a queue
+var queueDepthRegex = regexp.MustCompile(`QUEUE_(DEPTH|SIZE)$`)
+
+// Weight of the latest value for the smoothed queue depth
+const queueDepthSmoothing = 0.3
+
+var (
+	queueDepthMu     sync.Mutex
+	queueDepthTrends = map[string]float64{}
+)
+
+// setQueueDepthTrend exposes an exponential moving average of the queue depth
+// counters of acdqueued targets, which distinguishes a growing backlog from a
+// momentary spike.
+func setQueueDepthTrend(prefix, daemon string, metric usageCounter) {
+	if daemon != "acdqueued" || !queueDepthRegex.MatchString(metric.Name) {
+		return
+	}
+	name := `c5_acdqueued_queue_depth_trend{target="` + prefix + `",counter="` + strings.ToLower(metric.Name) + `"`
+	if metric.Idx != nil {
+		name += `,` + idxLabel() + `="` + strconv.Itoa(*metric.Idx) + `"`
+	}
+	name += "}"
+	queueDepthMu.Lock()
+	defer queueDepthMu.Unlock()
+	trend, ok := queueDepthTrends[name]
+	if ok {
+		trend += queueDepthSmoothing * (float64(metric.Current) - trend)
+	} else {
+		trend = float64(metric.Current)
+	}
+	queueDepthTrends[name] = trend
+	getFloatCounter(name).Set(roundAverage(trend))
+}
+
+// forgetQueueDepthTrends removes the queue depth trends of the targets with
+// the given prefix, so smoothing starts over once they are queried again
+func forgetQueueDepthTrends(prefix string) {
+	label := `c5_acdqueued_queue_depth_trend{target="` + prefix
+	queueDepthMu.Lock()
+	defer queueDepthMu.Unlock()
+	for name := range queueDepthTrends {
+		if strings.HasPrefix(name, label) {
+			delete(queueDepthTrends, name)
+			unregisterMetric(name)
+		}
+	}
+}
+
+// roundAverage applies the configured rounding to an emitted average. The
+// unrounded value is kept for further smoothing.
+func roundAverage(v float64) float64 {
+	switch config.AppConfig.AverageRounding {
+	case "round":
+		return math.Round(v)
+	case "floor":
+		return math.Floor(v)
+	case "ceil":
+		return math.Ceil(v)
+	}
+	return v
+}
+
 func setLabeledUsageMetric(prefix string, label string, metric usageCounter) {
 	// logDebug("set labeled usage metric for ", prefix, metric.Name)
-	current := buildMetricName(prefix, `current{`+label+`="`+metric.Name+`"}`, metric.Idx)
+	labels := `{` + label + `="` + metric.Name + `"}`
+	cnts := []usageCounter{metric}
+	if setByteUnit(prefix, cnts) {
+		for _, suffix := range usageSuffixes[1:] {
+			unregisterMetric(buildMetricName(prefix, "", strings.TrimPrefix(suffix, "_")+labels, metric.Idx))
+		}
+	}
+	metric = cnts[0]
+	current := buildMetricName(prefix, "", strings.TrimPrefix(usageSuffix("_current", metric.Bytes), "_")+labels, metric.Idx)
 	setMetricValue(current, metric.Current)
-	lastMin := buildMetricName(prefix, `lastmin{`+label+`="`+metric.Name+`"}`, metric.Idx)
+	lastMin := buildMetricName(prefix, "", strings.TrimPrefix(usageSuffix("_lastmin", metric.Bytes), "_")+labels, metric.Idx)
 	setMetricValue(lastMin, metric.LastMin)
-	lastAvg := buildMetricName(prefix, `lastavg{`+label+`="`+metric.Name+`"}`, metric.Idx)
+	lastAvg := buildMetricName(prefix, "", strings.TrimPrefix(usageSuffix("_lastavg", metric.Bytes), "_")+labels, metric.Idx)
 	setMetricValue(lastAvg, metric.LastAvg)
-	lastMax := buildMetricName(prefix, `lastmax{`+label+`="`+metric.Name+`"}`, metric.Idx)
+	lastMax := buildMetricName(prefix, "", strings.TrimPrefix(usageSuffix("_lastmax", metric.Bytes), "_")+labels, metric.Idx)
 	setMetricValue(lastMax, metric.LastMax)
 }
 
 func setCounterMetric(prefix string, metric eventCounter) {
 	// logDebug("set counter metric for ", prefix, metric.Name)
-	current := buildMetricName(prefix, metric.Name+"_total", metric.Idx)
+	if config.AppConfig.CounterTypes[metric.Name] == "gauge" {
+		current := buildMetricName(prefix, metric.Section, metric.Name+"_current", metric.Idx)
+		setMetricValue(current, metric.Total)
+		if !config.AppConfig.KeepOldCounterTypes {
+			return
+		}
+	}
+	if mode := config.AppConfig.EventCounterDeltas; mode != "" {
+		name := buildMetricName(prefix, metric.Section, metric.Name+"_delta", metric.Idx)
+		if delta, ok := eventCounterDelta(prefix, name, metric.Total); ok {
+			setMetricValue(name, delta)
+		}
+		if mode == "instead" {
+			return
+		}
+	}
+	current := buildMetricName(prefix, metric.Section, metric.Name+"_total", metric.Idx)
 	setMetricValue(current, metric.Total)
 }
 
 func setLabeledCounterMetric(prefix string, label string, metric eventCounter) {
 	// logDebug("set labeled counter metric for ", prefix, metric.Name)
-	current := buildMetricName(prefix, `total{`+label+`="`+metric.Name+`"}`, metric.Idx)
+	current := buildMetricName(prefix, "", `total{`+label+`="`+metric.Name+`"}`, metric.Idx)
 	setMetricValue(current, metric.Total)
 }
 
 func setMetricValue(name string, value uint64) {
 	// logDebug("set metric ", name, "value", value)
-	metricSet.GetOrCreateCounter(name).Set(value)
+	if !allowSeries(name) {
+		return
+	}
+	getCounter(name).Set(value)
 }
 
-func parseInt64(str string) int64 {
-	// logDebug("Attempting to parse string as int64: '%s'", str)
-	i64, err := strconv.ParseInt(str, 10, 63)
+// Unit suffixes removed from counter values like "95%" or "20ms"
+var valueSuffixes = []string{"%", "ms", "s"}
+
+// parseUint64 parses a counter value. Negative values, e.g. "-1" for
+// uninitialized fields, are exported as 0. Values exceeding the uint64 range
+// are clamped to its maximum instead of wrapping around. Hexadecimal values
+// like "0x1F" and known unit suffixes are accepted, other invalid values are
+// exported as 0 and counted.
+func parseUint64(str string) uint64 {
+	u64, _ := parseValue(str)
+	return u64
+}
+
+// parseValue parses a counter value like parseUint64. It returns false if
+// the value is invalid.
+func parseValue(str string) (uint64, bool) {
+	digits := strings.TrimPrefix(str, "+")
+	negative := strings.HasPrefix(digits, "-")
+	digits = strings.TrimPrefix(digits, "-")
+	for _, suffix := range valueSuffixes {
+		if strings.HasSuffix(digits, suffix) && len(digits) > len(suffix) {
+			digits = strings.TrimSuffix(digits, suffix)
+			break
+		}
+	}
+	base := 10
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		digits, base = digits[2:], 16
+	}
+	u64, err := strconv.ParseUint(digits, base, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		logError("Failed to parse as uint64:", str)
+		getCounter(`c5_invalid_values_total`).Inc()
+		return 0, false
+	}
+	if negative && (u64 > 0 || err != nil) {
+		// Avoid exporting huge values for negative numbers
+		logDebug("Ignoring negative value", str)
+		getCounter(`c5_negative_values_total`).Inc()
+		return 0, true
+	}
 	if err != nil {
-		log.Fatal("Failed to parse as int64:", str)
+		return counterOverflow(str), true
 	}
-	return i64
+	return u64, true
 }
 
-func parseUint64(str string) uint64 {
-	return uint64(parseInt64(str))
+// counterOverflow counts values exceeding the uint64 range and returns the
+// clamped value
+func counterOverflow(str string) uint64 {
+	logError("Clamping value exceeding the uint64 range:", str)
+	getCounter(`c5_counter_overflow_total`).Inc()
+	return math.MaxUint64
 }
 
-func parseBuildString(build string) (version string) {
+var versionRegex = regexp.MustCompile(`^\d+(\.\d+)+$`)
+
+func parseBuildString(build string) (version string, ok bool) {
 	// "Version: 6.0.2.57, compiled on Jan 15 2020, 13:06:31 built by TELES Communication Systems GmbH",
+	// or without prefix: "6.0.2.57, compiled on ..."
 	parts := strings.Split(build, ",")
-	version = strings.TrimPrefix(parts[0], "Version: ")
-	return
+	version = strings.TrimSpace(parts[0])
+	version = strings.TrimSpace(strings.TrimPrefix(version, "Version:"))
+	if !versionRegex.MatchString(version) {
+		return "", false
+	}
+	return version, true
+}
+
+// Formats of the build string distinguished by buildStringFormat
+var buildStringFormats = []string{"prefixed", "bare", "invalid"}
+
+// buildStringFormat returns which format parseBuildString handled for the
+// given build string and parse outcome
+func buildStringFormat(build string, ok bool) string {
+	switch {
+	case !ok:
+		return "invalid"
+	case strings.HasPrefix(strings.TrimSpace(build), "Version:"):
+		return "prefixed"
+	default:
+		return "bare"
+	}
+}
+
+// setBuildStringFormat marks the format of the last build string of the
+// target, so drift of the build line between releases is observable
+func setBuildStringFormat(prefix, format string) {
+	for _, f := range buildStringFormats {
+		var v uint64
+		if f == format {
+			v = 1
+		}
+		getCounter(`c5_build_string_format{target="` + prefix + `",format="` + f + `"}`).Set(v)
+	}
+}
+
+// Memory usage parsers distinguished by setMemoryParser, "none" if neither
+// produced the memory values
+var memoryParsers = []string{"regex", "string", "none"}
+
+// setMemoryParser marks the parser which produced the current memory values
+// of the target, so the active code path is observable per node
+func setMemoryParser(prefix, impl string) {
+	for _, p := range memoryParsers {
+		var v uint64
+		if p == impl {
+			v = 1
+		}
+		getCounter(`c5_` + prefix + `_memory_parser{impl="` + p + `"}`).Set(v)
+	}
 }
 
 func parseDataSize(str string) uint64 {
 	unit := strings.TrimLeft(str, "0123456789")
 	size := parseUint64(strings.TrimSuffix(str, unit))
+	var factor uint64 = 1
 	switch strings.ToLower(unit) {
 	case "kb":
-		return size * 1024
+		factor = 1024
 	case "mb":
-		return size * 1024 * 1024
+		factor = 1024 * 1024
 	case "gb":
-		return size * 1024 * 1024 * 1024
+		factor = 1024 * 1024 * 1024
 	case "tb":
-		return size * 1024 * 1024 * 1024 * 1024
+		factor = 1024 * 1024 * 1024 * 1024
 	}
-	return size
+	if size > math.MaxUint64/factor {
+		return counterOverflow(str)
+	}
+	return size * factor
 }
 
 func parseMemoryString(memoryUsage string) (memUsed, memTotal, memMaxUsage uint64) {
 	// R6.0: "memoryUsage" : "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793",
 	// R6.2: "memoryUsage" : "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205",
+	// Keys are matched case-insensitively, R6.0 uses "Max:" and R6.2 "MAX:"
 	parts := strings.Split(memoryUsage, "-")
 	for _, p := range parts {
 		param := strings.SplitN(strings.TrimSpace(p), ":", 2)
@@ -201,6 +772,7 @@ func parseMemoryString(memoryUsage string) (memUsed, memTotal, memMaxUsage uint6
 func parseMemoryStringRegex(memoryUsage string) (memUsed, memTotal, memMaxUsage uint64) {
 	// R6.0: "memoryUsage" : "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793",
 	// R6.2: "memoryUsage" : "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205",
+	// Case-insensitive like parseMemoryString, R6.0 uses "Max:" and R6.2 "MAX:"
 	memRegex := regexp.MustCompile(`(?i)mem used:(?: *\d+%)? *(\d+[tgmkb]*) .* mem total: *(\d+[tgmkb]*).* max: *(\d+)%`)
 	matches := memRegex.FindStringSubmatch(memoryUsage)
 	if len(matches) > 1 {
@@ -229,6 +801,23 @@ func parseProcessStateString(state ...string) uint64 {
 	return 3
 }
 
+// isStandbyState returns 1 if the first non-empty state is one of the
+// configured standby states, otherwise 0
+func isStandbyState(state ...string) uint64 {
+	for _, s := range state {
+		if s == "" {
+			continue
+		}
+		for _, standby := range config.AppConfig.StandbyStates {
+			if s == standby {
+				return 1
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
 func parseQueueStateString(state string) uint64 {
 	if strings.HasPrefix(state, "OK") {
 		return 1
@@ -236,34 +825,146 @@ func parseQueueStateString(state string) uint64 {
 	return 0
 }
 
+// Default positions of the current, lMin, lMax and lAvg values of usage
+// counters, counted from the first value after the counter name
+var defaultUsageColumns = []int{0, 3, 4, 5}
+
+// Maximum position of a configured usage counter value
+const maxUsageColumn = 15
+
+// usageColumns returns the configured positions of the usage counter values
+func usageColumns() []int {
+	if len(config.AppConfig.UsageColumns) == 0 {
+		return defaultUsageColumns
+	}
+	return config.AppConfig.UsageColumns
+}
+
+// validateUsageColumns checks the configured positions of the usage counter values
+func validateUsageColumns(conf *config.AppConfiguration) error {
+	if len(conf.UsageColumns) == 0 {
+		return nil
+	}
+	if len(conf.UsageColumns) != len(defaultUsageColumns) {
+		return fmt.Errorf("usageColumns must contain the positions of current, lMin, lMax and lAvg: %v", conf.UsageColumns)
+	}
+	for _, c := range conf.UsageColumns {
+		if c < 0 || c > maxUsageColumn {
+			return fmt.Errorf("usageColumns position %d out of range 0-%d", c, maxUsageColumn)
+		}
+	}
+	return nil
+}
+
+// Usage counter values with data size unit like "57MB"
+var dataSizeRegex = regexp.MustCompile(`^\d+(?i:[kmgt]?b)$`)
+
+// parseUsageValues parses the values of a usage counter line at the
+// configured positions. It returns false if the line is too short. Values
+// with data size unit are converted to bytes, which marks the counter as
+// reported in bytes.
+func parseUsageValues(values []string, c *usageCounter) bool {
+	cols := usageColumns()
+	for _, col := range cols {
+		if col >= len(values) {
+			return false
+		}
+	}
+	for i, v := range []*uint64{&c.Current, &c.LastMin, &c.LastMax, &c.LastAvg} {
+		if value := values[cols[i]]; dataSizeRegex.MatchString(value) {
+			*v = parseDataSize(value)
+			c.Bytes = true
+			continue
+		}
+		var ok bool
+		if *v, ok = parseValue(values[cols[i]]); !ok {
+			c.Invalid++
+		}
+	}
+	return true
+}
+
+// normalizeCounterLine removes extra quoting added by intermediate proxies,
+// which misaligns the fields of a line. Surrounding quotes are trimmed and
+// double escaped lines like `  0 TRANSPORT_MESSAGE_IN\t6502` are unescaped,
+// as plain counter lines never contain backslashes.
+func normalizeCounterLine(line string) (string, bool) {
+	normalized := false
+	if t := strings.TrimSpace(line); len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"' {
+		line = t[1 : len(t)-1]
+		normalized = true
+	}
+	if strings.Contains(line, `\`) {
+		if s, err := strconv.Unquote(`"` + line + `"`); err == nil {
+			line = s
+			normalized = true
+		}
+	}
+	return line, normalized
+}
+
+// isCounterLine returns true if the line starts with a numeric counter ID
+func isCounterLine(line string) bool {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return false
+	}
+	_, err := strconv.ParseUint(parts[0], 10, 64)
+	return err == nil
+}
+
 func parseUsageCounter(line string) usageCounter {
 	// "       Usage counters                              current    min    max   lMin   lMax   lAvg",
 	// " 45 CALL_CONTROL_ACTIVE_CALLS                           0      0      0      0      0      0",
 	parts := strings.Fields(line)
-	if len(parts) < 8 {
+	if len(parts) < 3 || !isCounterLine(line) {
+		return usageCounter{}
+	}
+	c := usageCounter{
+		ID:   parts[0],
+		Name: normalizeMetricName(parts[1]),
+	}
+	if !parseUsageValues(parts[2:], &c) {
 		return usageCounter{}
 	}
-	return usageCounter{
-		ID:      parts[0],
-		Name:    normalizeMetricName(parts[1]),
-		Current: parseUint64(parts[2]),
-		LastMin: parseUint64(parts[5]),
-		LastMax: parseUint64(parts[6]),
-		LastAvg: parseUint64(parts[7]),
+	return c
+}
+
+// Default maximum number of continuation lines parsed per usage counter block
+const defaultMaxSubUsageLines = 1024
+
+func maxSubUsageLines() int {
+	if config.AppConfig.MaxSubUsageLines > 0 {
+		return config.AppConfig.MaxSubUsageLines
 	}
+	return defaultMaxSubUsageLines
 }
 
-func parseSubUsageCounter(lines []string) (cnts []usageCounter) {
+func parseSubUsageCounter(lines []string) (cnts []usageCounter, capped int) {
 	// [
 	//   " 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      3      0      9      0",
 	//   "                                                      0      0      3      0      4      0",
 	// ]
-	// Name must be derived from first line, additional index must be added
+	// Name must be derived from first line, additional index must be added.
+	// Blank lines are skipped and don't count as entry. Continuation lines
+	// beyond maxSubUsageLines are dropped and counted in capped, so a
+	// malformed block can't create an unbounded number of series.
 	name := ""
 	id := ""
-	for i, line := range lines {
+	i := 0
+	max := maxSubUsageLines()
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			logDebug("Ignore blank sub usage counter line of", name)
+			continue
+		}
+		if i > max {
+			capped++
+			continue
+		}
 		idx := i
-		if i == 0 {
+		i++
+		if idx == 0 {
 			c := parseUsageCounter(line)
 			if c.Name == "" {
 				logError("Failed to parse as sub usage counter header:", line)
@@ -274,21 +975,16 @@ func parseSubUsageCounter(lines []string) (cnts []usageCounter) {
 			id = c.ID
 			cnts = append(cnts, c)
 		} else {
-			parts := strings.Fields(line)
-			if len(parts) < 6 {
+			c := usageCounter{
+				ID:   id,
+				Name: normalizeMetricName(name),
+				Idx:  &idx,
+			}
+			if !parseUsageValues(strings.Fields(line), &c) {
 				logError("Failed to parse as sub usage counter:", line)
 				continue
 			}
-			cnts = append(cnts,
-				usageCounter{
-					ID:      id,
-					Name:    normalizeMetricName(name),
-					Idx:     &idx,
-					Current: parseUint64(parts[0]),
-					LastMin: parseUint64(parts[3]),
-					LastMax: parseUint64(parts[4]),
-					LastAvg: parseUint64(parts[5]),
-				})
+			cnts = append(cnts, c)
 		}
 	}
 	return
@@ -298,14 +994,24 @@ func parseEventCounter(line string) eventCounter {
 	// "       Event counters                              absolute   curr   last",
 	// "  0 TRANSPORT_MESSAGE_IN                              6461     31     69",
 	parts := strings.Fields(line)
-	if len(parts) < 3 {
+	if len(parts) < 3 || !isCounterLine(line) {
 		return eventCounter{}
 	}
-	return eventCounter{
-		ID:    parts[0],
-		Name:  normalizeMetricName(parts[1]),
-		Total: parseUint64(parts[2]),
+	c := eventCounter{
+		ID:   parts[0],
+		Name: normalizeMetricName(parts[1]),
 	}
+	c.Total, c.Invalid = parseEventValue(parts[2])
+	return c
+}
+
+// parseEventValue parses the absolute value of an event counter, returning
+// the number of invalid values
+func parseEventValue(str string) (uint64, int) {
+	if total, ok := parseValue(str); ok {
+		return total, 0
+	}
+	return 0, 1
 }
 
 func parseSubEventCounter(lines []string) (cnts []eventCounter) {
@@ -313,12 +1019,19 @@ func parseSubEventCounter(lines []string) (cnts []eventCounter) {
 	//   "425 CASS_ERR_CONN_TMO                                  0      0      0",
 	//   "                                                     131    386    518"
 	// ],
-	// Name must be derived from first line, additional index must be added
+	// Name must be derived from first line, additional index must be added.
+	// Blank lines are skipped and don't count as entry.
 	name := ""
 	id := ""
-	for i, line := range lines {
+	i := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			logDebug("Ignore blank sub event counter line of", name)
+			continue
+		}
 		idx := i
-		if i == 0 {
+		i++
+		if idx == 0 {
 			c := parseEventCounter(line)
 			if c.Name == "" {
 				logError("Failed to parse as sub event counter header:", line)
@@ -334,54 +1047,281 @@ func parseSubEventCounter(lines []string) (cnts []eventCounter) {
 				logError("Failed to parse as sub event counter:", line)
 				return
 			}
-			cnts = append(cnts,
-				eventCounter{
-					ID:    id,
-					Name:  normalizeMetricName(name),
-					Idx:   &idx,
-					Total: parseUint64(parts[0]),
-				})
+			c := eventCounter{
+				ID:   id,
+				Name: normalizeMetricName(name),
+				Idx:  &idx,
+			}
+			c.Total, c.Invalid = parseEventValue(parts[0])
+			cnts = append(cnts, c)
 		}
 	}
 	return
 }
-func processC5StateCounter(prefix string, lines []interface{}) {
+
+// parseTimer accumulates the parse duration per counter family, it is only
+// used if verbose parser metrics are enabled.
+type parseTimer map[string]time.Duration
+
+func newParseTimer() parseTimer {
+	if !config.AppConfig.Verbose {
+		return nil
+	}
+	return parseTimer{}
+}
+
+func (pt parseTimer) start() time.Time {
+	if pt == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (pt parseTimer) stop(family string, start time.Time) {
+	if pt != nil {
+		pt[family] += time.Since(start)
+	}
+}
+
+func (pt parseTimer) setMetrics(prefix string) {
+	for family, d := range pt {
+		getFloatCounter(`c5_parse_family_duration_seconds{target="` + prefix + `",family="` + family + `"}`).Set(d.Seconds())
+	}
+}
+
+// Serializes the parse phases measured by measureAllocs
+var measureAllocsMu sync.Mutex
+
+// measureAllocs samples the bytes allocated by the process until the returned
+// function is called, exposed as c5_parse_alloc_bytes of the given parse
+// phase. Reading the memory stats stops the world, so it is only done if
+// allocation profiling is enabled.
+// The runtime only counts the allocations of the whole process, so measured
+// phases of concurrent queries are run one at a time. Allocations of other
+// work, like serving metrics or receiving other responses, are still
+// included.
+func measureAllocs(prefix, phase string) func() {
+	if !config.AppConfig.ProfileAllocations {
+		return func() {}
+	}
+	measureAllocsMu.Lock()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		measureAllocsMu.Unlock()
+		getCounter(`c5_parse_alloc_bytes{target="` + prefix + `",phase="` + phase + `"}`).Set(after.TotalAlloc - before.TotalAlloc)
+	}
+}
+
+// counterStats summarizes the counters processed from a single response
+type counterStats struct {
+	names       map[string]bool // Names of all processed counters
+	fieldCounts map[int]uint64  // Number of counter lines per field count, nil unless verbose
+	singleline  uint64          // Number of single line usage counters
+	multiline   uint64          // Number of multi-line usage counter blocks
+	failed      uint64          // Number of counter lines which could not be parsed
+	normalized  uint64          // Number of counter lines with extra quoting removed
+	fields      uint64          // Number of numeric values attempted to parse
+	invalid     uint64          // Number of numeric values which could not be parsed
+}
+
+// addFailed counts the non-blank lines of a multi-line counter which didn't
+// result in a counter, and their values as invalid
+func (cs *counterStats) addFailed(lines []string, parsed, values int) {
+	n := 0
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			n++
+		}
+	}
+	if n > parsed {
+		cs.failed += uint64(n - parsed)
+		cs.addFields(values*(n-parsed), values*(n-parsed))
+	}
+}
+
+// addFields counts the values attempted to parse and the invalid ones
+func (cs *counterStats) addFields(values, invalid int) {
+	cs.fields += uint64(values)
+	cs.invalid += uint64(invalid)
+}
+
+// fieldSuccessRatio returns the share of the values parsed successfully,
+// 1 if there were none
+func (cs counterStats) fieldSuccessRatio() float64 {
+	if cs.fields == 0 {
+		return 1
+	}
+	return float64(cs.fields-cs.invalid) / float64(cs.fields)
+}
+
+func (cs *counterStats) add(name string) {
+	if name != "" {
+		cs.names[name] = true
+	}
+}
+
+// countFields records the number of fields of a counter line
+func (cs *counterStats) countFields(lines ...string) {
+	if cs.fieldCounts == nil {
+		return
+	}
+	for _, l := range lines {
+		cs.fieldCounts[len(strings.Fields(l))]++
+	}
+}
+
+// setFieldCountMetrics exposes the field count distribution of the last
+// scrape, which changes immediately if the format of the lines drifts.
+func (cs counterStats) setFieldCountMetrics(prefix string) {
+	if cs.fieldCounts == nil {
+		return
+	}
+	clearMetrics(`c5_line_field_count{target="` + prefix + `",`)
+	for count, lines := range cs.fieldCounts {
+		name := `c5_line_field_count{target="` + prefix + `",count="` + strconv.Itoa(count) + `"}`
+		getCounter(name).Set(lines)
+	}
+}
+
+var counterHeaderRegex = regexp.MustCompile(`^\s*(Event|Usage)\s+counters(\s|$)`)
+
+// counterHeaderType returns "event" or "usage" if the line is the header of
+// the respective counter table, otherwise an empty string. Only the leading
+// title is considered, so counter lines and names containing the title don't
+// toggle the type.
+//
+// "       Event counters                              absolute   curr   last",
+func counterHeaderType(line string) string {
+	m := counterHeaderRegex.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	return strings.ToLower(m[1])
+}
+
+// counterInfo is an element of the counterInfos of a state response, either
+// a single line or the lines of a multi-line counter
+type counterInfo struct {
+	line      string
+	sublines  []string
+	multiline bool
+	threshold *float64 // Threshold of counters with nested details
+}
+
+// decodeCounterInfo decodes an element of counterInfos using typed code
+// paths for strings and string arrays, and for objects with nested details
+// if counterDetails is enabled. Other elements are ignored.
+func decodeCounterInfo(raw json.RawMessage) (info counterInfo, ok bool) {
+	if len(raw) > 0 && raw[0] == '{' && config.AppConfig.CounterDetails {
+		return parseCounterDetails(raw)
+	}
+	return decodeCounterLines(raw)
+}
+
+// decodeCounterLines decodes a single counter line or the lines of a
+// multi-line counter
+func decodeCounterLines(raw json.RawMessage) (info counterInfo, ok bool) {
+	if len(raw) == 0 {
+		return info, false
+	}
+	switch raw[0] {
+	case '"':
+		return info, json.Unmarshal(raw, &info.line) == nil
+	case '[':
+		info.multiline = true
+		return info, json.Unmarshal(raw, &info.sublines) == nil
+	}
+	return info, false
+}
+
+func processC5StateCounter(prefix, daemon string, lines []json.RawMessage) (stats counterStats) {
 	const event, usage string = "event", "usage"
-	var cntType string
-	for _, line := range lines {
-		v := reflect.ValueOf(line)
-		switch v.Kind() {
-		case reflect.Slice, reflect.Array:
-			sublines := make([]string, v.Len())
-			for i := 0; i < v.Len(); i++ {
-				sublines[i] = v.Index(i).Elem().String()
+	var cntType, section string
+	stats.names = map[string]bool{}
+	if config.AppConfig.Verbose {
+		stats.fieldCounts = map[int]uint64{}
+	}
+	pt := newParseTimer()
+	for _, raw := range lines {
+		info, ok := decodeCounterInfo(raw)
+		if !ok {
+			logDebug(prefix, "ignore element of unknown type", string(raw))
+			continue
+		}
+		threshold := info.threshold
+		if info.multiline {
+			sublines := info.sublines
+			for i, l := range sublines {
+				l, normalized := normalizeCounterLine(l)
+				if normalized {
+					stats.normalized++
+				}
+				sublines[i] = l
+			}
+			if cntType == usage || cntType == event {
+				stats.countFields(sublines...)
 			}
 			if cntType == usage {
-				cnts := parseSubUsageCounter(sublines)
+				stats.multiline++
+				start := pt.start()
+				cnts, capped := parseSubUsageCounter(sublines)
+				stats.addFailed(sublines, len(cnts)+capped, len(usageColumns()))
+				if capped > 0 {
+					logError("Dropped", capped, "sub usage counter lines of", prefix, "exceeding", maxSubUsageLines())
+					getCounter(`c5_sub_usage_lines_capped_total{target="` + prefix + `"}`).Add(capped)
+				}
+				for i := range cnts {
+					cnts[i].Section = section
+				}
+				if setByteUnit(prefix, cnts) {
+					clearUnitlessUsage(prefix, cnts[0])
+				}
 				for _, c := range cnts {
 					setUsageMetric(prefix, c)
+					setQueueDepthTrend(prefix, daemon, c)
+					stats.add(c.Name)
+					stats.addFields(len(usageColumns()), c.Invalid)
 				}
+				setSubUsageSum(prefix, cnts)
+				pt.stop("subusage", start)
 			} else if cntType == event {
 				// Workaround for CSTAGW
 				// see https://github.com/communi5/prometheus-c5-exporter/issues/1
-				if prefix == "cstagwd" && len(sublines) < 2 {
-					logDebug("Ignore invalid event sublines for cstagwd", sublines)
+				if daemon == "cstagwd" && len(sublines) < 2 {
+					logDebug("Ignore invalid event sublines for cstagwd", prefix, sublines)
 					continue
 				}
+				start := pt.start()
 				cnts := parseSubEventCounter(sublines)
+				stats.addFailed(sublines, len(cnts), 1)
 				for _, c := range cnts {
+					c.Section = section
 					setCounterMetric(prefix, c)
+					stats.add(c.Name)
+					stats.addFields(1, c.Invalid)
 				}
+				pt.stop("subevent", start)
 			} else {
 				logDebug(prefix, "ignoring line for unknown type", sublines)
 			}
-		case reflect.String:
-			l := line.(string)
-			if strings.Contains(l, "Event counters") {
-				cntType = event
+		} else {
+			l, normalized := normalizeCounterLine(info.line)
+			if normalized {
+				stats.normalized++
+			}
+			if header := counterHeaderType(l); header != "" {
+				cntType, section = header, ""
+				continue
+			} else if s := counterSection(l); s != "" && config.AppConfig.CounterSections != "" && cntType != "" {
+				logDebug(prefix, "counter section", s)
+				section = s
 				continue
-			} else if strings.Contains(l, "Usage counters") {
-				cntType = usage
+			} else if !isCounterLine(l) {
+				// Section labels or other lines not starting with a counter ID
+				logDebug(prefix, "ignore non-counter line", l)
 				continue
 			} else if strings.HasPrefix(l, "    ") {
 				// Skip unknown elements like the OBSERVERS line:
@@ -390,41 +1330,128 @@ func processC5StateCounter(prefix string, lines []interface{}) {
 				logDebug(prefix, "ignore line", l)
 				continue
 			}
+			if cntType == usage || cntType == event {
+				stats.countFields(l)
+			}
 			if cntType == usage {
+				stats.singleline++
+				start := pt.start()
 				c := parseUsageCounter(l)
+				if c.Name == "" {
+					logError("Failed to parse usage counter of", prefix+":", l)
+					stats.failed++
+					stats.addFields(len(usageColumns()), len(usageColumns()))
+					continue
+				}
+				stats.addFields(len(usageColumns()), c.Invalid)
+				c.Section = section
+				cnts := []usageCounter{c}
+				if setByteUnit(prefix, cnts) {
+					clearUnitlessUsage(prefix, c)
+				}
+				c = cnts[0]
 				setUsageMetric(prefix, c)
+				setQueueDepthTrend(prefix, daemon, c)
+				setThresholdMetric(prefix, c.Section, c.Name, c.Idx, threshold)
+				stats.add(c.Name)
+				pt.stop(usage, start)
 			} else if cntType == event {
+				start := pt.start()
 				c := parseEventCounter(l)
+				if c.Name == "" {
+					logError("Failed to parse event counter of", prefix+":", l)
+					stats.failed++
+					stats.addFields(1, 1)
+					continue
+				}
+				stats.addFields(1, c.Invalid)
+				c.Section = section
 				setCounterMetric(prefix, c)
+				setThresholdMetric(prefix, c.Section, c.Name, c.Idx, threshold)
+				stats.add(c.Name)
+				pt.stop(event, start)
 			} else {
 				logDebug(prefix, "ignoring line", l)
 			}
 			// logDebug("line type", cntType, line)
 		}
 	}
+	pt.setMetrics(prefix)
+	stats.setFieldCountMetrics(prefix)
+	// Shape of the response, which changes if its structure changes
+	getCounter(`c5_usage_counters_singleline{target="` + prefix + `"}`).Set(stats.singleline)
+	getCounter(`c5_usage_counters_multiline{target="` + prefix + `"}`).Set(stats.multiline)
+	setParseSuccess(`c5_counter_parse_success{target="`+prefix+`"}`, stats.failed == 0)
+	getFloatCounter(`c5_parse_field_success_ratio{target="` + prefix + `"}`).Set(stats.fieldSuccessRatio())
+	if stats.normalized > 0 {
+		logDebug("Removed extra quoting of", stats.normalized, "counter lines of", prefix)
+		getCounter(`c5_counter_lines_normalized_total{target="` + prefix + `"}`).Add(int(stats.normalized))
+	}
 	return
 }
 
+// parseCounterDetails returns the counter lines and the optional threshold of
+// counters with nested details, as reported by richer C5 APIs:
+//
+//	{ "counter" : " 45 CALL_CONTROL_ACTIVE_CALLS     0      0 ...", "details" : { "threshold" : 500 } }
+//
+// Details without a numeric threshold are ignored.
+func parseCounterDetails(raw json.RawMessage) (info counterInfo, ok bool) {
+	var element struct {
+		Counter json.RawMessage `json:"counter"`
+		Details json.RawMessage `json:"details"`
+	}
+	if json.Unmarshal(raw, &element) != nil {
+		return info, false
+	}
+	if info, ok = decodeCounterLines(element.Counter); !ok {
+		return info, false
+	}
+	var details struct {
+		Threshold json.RawMessage `json:"threshold"`
+	}
+	if json.Unmarshal(element.Details, &details) == nil {
+		var threshold *float64
+		if json.Unmarshal(details.Threshold, &threshold) == nil {
+			info.threshold = threshold
+		}
+	}
+	return info, true
+}
+
+// setThresholdMetric exports the threshold configured in C5 for a counter,
+// so alerts can compare against it
+func setThresholdMetric(prefix, section, name string, idx *int, threshold *float64) {
+	if threshold == nil || name == "" {
+		return
+	}
+	metricName := buildMetricName(prefix, section, name+"_threshold", idx)
+	if !allowSeries(metricName) {
+		return
+	}
+	getFloatCounter(metricName).Set(*threshold)
+}
+
 // processC5CounterMetrics will parse a counter output of type EVENT and USAGE for
 // a specific C5 metric.
 //
-// {
-//   "proxyResponseTimeStampAndState:" : "2021-02-25 10:31:48  active",
-//   "counterName" : "BT_CALLS_LIMIT_REACHED",
-//   "counterType" : "EVENT",
-//   "absoluteValue" : 0,
-//   "currentValue" : 0,
-//   "lastValue" : 0,
-//   "tableValues" : [
-//     "name                            absolute   curr   last",
-//     "trunkname1.ipcentrex.internal         0      0      0",
-//     "trunk2.otherprovider.at               0      0      0",
-//   ],
-//   "tableCountInfo" : "curComponentCount2: 14 (10000) "
-// }
+//	{
+//	  "proxyResponseTimeStampAndState:" : "2021-02-25 10:31:48  active",
+//	  "counterName" : "BT_CALLS_LIMIT_REACHED",
+//	  "counterType" : "EVENT",
+//	  "absoluteValue" : 0,
+//	  "currentValue" : 0,
+//	  "lastValue" : 0,
+//	  "tableValues" : [
+//	    "name                            absolute   curr   last",
+//	    "trunkname1.ipcentrex.internal         0      0      0",
+//	    "trunk2.otherprovider.at               0      0      0",
+//	  ],
+//	  "tableCountInfo" : "curComponentCount2: 14 (10000) "
+//	}
 func processC5CounterMetrics(basePrefix string, data c5CounterResponse) {
 	const event, usage string = "EVENT", "USAGE"
-	prefix := basePrefix + "_" + strings.ToLower(data.CounterName)
+	prefix := metricNameCase(basePrefix + "_" + data.CounterName)
 	setMetricValue(prefix+`_current`, data.CurrentValue)
 	logDebug("Processing", prefix, "type", data.CounterType)
 	if data.CounterType == event {
@@ -437,103 +1464,660 @@ func processC5CounterMetrics(basePrefix string, data c5CounterResponse) {
 		setMetricValue(prefix+`_lastmin`, data.LastMinValue)
 		setMetricValue(prefix+`_lastmax`, data.LastMaxValue)
 	}
-	// Parse values now
-	for _, line := range data.TableValues {
-		v := reflect.ValueOf(line)
-		switch v.Kind() {
-		case reflect.String:
-			l := line.(string)
-			if strings.HasPrefix(l, "name") {
-				continue
-			}
-			if data.CounterType == usage {
-				c := parseUsageCounter("0 " + l)
-				setLabeledUsageMetric(prefix+"_trunk", "name", c)
-			} else if data.CounterType == event {
-				c := parseEventCounter("0 " + l)
-				setLabeledCounterMetric(prefix+"_trunk", "name", c)
-			} else {
-				logDebug(prefix, "ignoring line", l)
-			}
+	// Parse values now
+	for _, line := range data.TableValues {
+		v := reflect.ValueOf(line)
+		switch v.Kind() {
+		case reflect.String:
+			l := line.(string)
+			if strings.HasPrefix(l, "name") {
+				continue
+			}
+			if data.CounterType == usage {
+				c := parseUsageCounter("0 " + l)
+				setLabeledUsageMetric(prefix+"_trunk", "name", c)
+			} else if data.CounterType == event {
+				c := parseEventCounter("0 " + l)
+				setLabeledCounterMetric(prefix+"_trunk", "name", c)
+			} else {
+				logDebug(prefix, "ignoring line", l)
+			}
+		}
+	}
+	return
+}
+
+func clearMetrics(prefix string) {
+	logDebug("Clear metric counters for", prefix)
+	forgetSeries(prefix)
+	forgetBuildVersions(prefix)
+	forgetByteCounters(prefix)
+	forgetQueueDepthTrends(prefix)
+	set := setFor(prefix)
+	for _, name := range set.ListMetricNames() {
+		if strings.HasPrefix(name, prefix) {
+			logDebug("Unregister metric counter", name)
+			set.UnregisterMetric(name)
+		}
+	}
+}
+
+// setScrapeError counts failed queries of a target by reason
+func setScrapeError(prefix, reason string) {
+	getCounter(`c5_scrape_errors_total{target="` + prefix + `",reason="` + reason + `"}`).Inc()
+}
+
+// setScrapeSuccess exposes whether the last query of a target succeeded.
+// Failed queries also mark the process as down, processBaseMetrics sets
+// c5_<prefix>_up according to the state otherwise.
+func setScrapeSuccess(prefix string, success bool) {
+	setParseSuccess(`c5_scrape_success{target="`+prefix+`"}`, success)
+	if !success {
+		setParseSuccess(`c5_`+prefix+`_up`, false)
+		clearScrapeDetails(prefix)
+	}
+	setNeverSucceeded(prefix, success)
+}
+
+// clearScrapeDetails removes the memory parser, build approval, standby flag
+// and query duration of a target, which are stale once its metrics are
+// cleared. The duration is set again by the next query finishing in time.
+func clearScrapeDetails(prefix string) {
+	clearMetrics(`c5_` + prefix + `_memory_parser{`)
+	unregisterMetric(`c5_` + prefix + `_build_approved`)
+	unregisterMetric(`c5_` + prefix + `_standby`)
+	unregisterMetric(`c5_scrape_duration_seconds{target="` + prefix + `"}`)
+}
+
+// clearScrapeStatus removes the exporter metrics describing the last query of
+// a target which is not queried anymore
+func clearScrapeStatus(prefix string) {
+	unregisterMetric(`c5_scrape_success{target="` + prefix + `"}`)
+	unregisterMetric(`c5_` + prefix + `_up`)
+	clearMetrics(`c5_` + prefix + `_response_content_type_info{`)
+	clearScrapeDetails(prefix)
+}
+
+// setScrapeDuration exposes the duration of the last query of a target next
+// to its effective timeout, so the share of the timeout used can be queried
+func setScrapeDuration(target config.Target, start time.Time) {
+	getFloatCounter(`c5_scrape_duration_seconds{target="` + target.Prefix + `"}`).Set(time.Since(start).Seconds())
+	getFloatCounter(`c5_scrape_timeout_seconds{target="` + target.Prefix + `"}`).Set(timeoutFor(target).Seconds())
+}
+
+// setParseSuccess sets the given metric to 1 on success, otherwise 0
+func setParseSuccess(name string, success bool) {
+	var v uint64
+	if success {
+		v = 1
+	}
+	getCounter(name).Set(v)
+}
+
+// setLastHTTPStatus exposes the status code of the last query of a target,
+// 0 if no response has been received
+func setLastHTTPStatus(prefix string, code int) {
+	getCounter(`c5_last_http_status{target="` + prefix + `"}`).Set(uint64(code))
+}
+
+// setResponseContentType exposes the media type of the last response, which
+// reveals e.g. HTML error pages of fronting proxies before decoding fails
+func setResponseContentType(prefix, contentType string) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "invalid"
+		if contentType == "" {
+			mediaType = "none"
+		}
+	}
+	family := `c5_` + prefix + `_response_content_type_info{`
+	name := family + `content_type="` + mediaType + `"}`
+	set := setFor(name)
+	for _, m := range set.ListMetricNames() {
+		if strings.HasPrefix(m, family) && m != name {
+			set.UnregisterMetric(m)
+		}
+	}
+	getCounter(name).Set(1)
+}
+
+// checkHTTPStatus handles responses with a status other than 200 OK
+func checkHTTPStatus(prefix string, resp *http.Response) bool {
+	if resp.StatusCode == http.StatusOK {
+		return true
+	}
+	logError("Unexpected response status for", prefix, resp.Status)
+	setScrapeError(prefix, "status")
+	return false
+}
+
+// connectErrorReason classifies errors of HTTP requests. DNS failures are
+// distinguished, as they usually indicate a typo in the configured URL
+// rather than a stopped process.
+func connectErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var connErr connectError
+	if errors.As(err, &connErr) && errors.As(connErr.err, &netErr) && netErr.Timeout() {
+		return "connect_timeout"
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "connect"
+}
+
+// sendRequest sends the request limited to the given timeout, which also
+// covers reading the response body until cancel is called. Zero disables the
+// timeout.
+func sendRequest(ctx context.Context, client *http.Client, req *http.Request, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	return resp, cancel, err
+}
+
+// connectError marks failures to establish a connection, to distinguish
+// unreachable processes from processes slow to respond
+type connectError struct {
+	err error
+}
+
+func (e connectError) Error() string { return e.err.Error() }
+
+func (e connectError) Unwrap() error { return e.err }
+
+// dialFunc opens the connections of a transport
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// withConnectTimeout limits the time dial may take to establish a connection.
+// A zero timeout only limits it by the deadline of the request.
+func withConnectTimeout(dial dialFunc, timeout time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, connectError{err}
+		}
+		return conn, nil
+	}
+}
+
+// handleConnectError logs and counts a failed request of a target
+func handleConnectError(prefix string, err error) {
+	reason := connectErrorReason(err)
+	if reason == "dns" {
+		logError("Failed to resolve host of", prefix, "please check the configured URL:", err)
+	} else {
+		logError("Failed to connect", err)
+	}
+	setScrapeError(prefix, reason)
+}
+
+// buildApproved returns 1 if the version is one of the approved versions or
+// no approved versions are configured, otherwise 0
+func buildApproved(version string) uint64 {
+	approved := config.AppConfig.ApprovedVersions
+	if len(approved) == 0 {
+		return 1
+	}
+	for _, v := range approved {
+		if v == version {
+			return 1
 		}
 	}
-	return
+	return 0
 }
 
-func clearMetrics(prefix string) {
-	logDebug("Clear metric counters for", prefix)
-	for _, name := range metricSet.ListMetricNames() {
-		if strings.HasPrefix(name, prefix) {
-			logDebug("Unregister metric counter", name)
-			metricSet.UnregisterMetric(name)
+// setParseWarning counts base fields of a response which could not be parsed
+func setParseWarning(prefix, field string) {
+	getCounter(`c5_parse_warnings_total{target="` + prefix + `",field="` + field + `"}`).Inc()
+}
+
+// Host name of the exporter, determined on first use
+var (
+	exporterHostnameOnce sync.Once
+	exporterHostname     string
+)
+
+func localHostname() string {
+	exporterHostnameOnce.Do(func() {
+		name, err := os.Hostname()
+		if err != nil {
+			logError("Unable to determine host name:", err)
+		}
+		exporterHostname = name
+	})
+	return exporterHostname
+}
+
+// targetNode returns the host name of the C5 node of a target. This is the
+// configured hostHeader, as the URL then addresses a tunnel or proxy, or else
+// the host of its URL. Local processes get the host name of the exporter.
+func targetNode(target config.Target) string {
+	var host string
+	if target.HostHeader != "" {
+		host = target.HostHeader
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+	} else {
+		u, err := url.Parse(target.URL)
+		if err != nil {
+			return ""
+		}
+		host = u.Hostname()
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		if name := localHostname(); name != "" {
+			return name
 		}
 	}
+	return host
 }
 
-func processBaseMetrics(prefix string, state c5StateResponse) {
+// processBaseMetrics sets the state, memory and version metrics. It returns
+// false if the response must be treated as failed scrape, which is the case
+// for invalid build versions if strictBuildVersion is enabled.
+func processBaseMetrics(target config.Target, state c5StateResponse) bool {
+	prefix, daemon := target.Prefix, target.Daemon
+	// Count empty or unparseable base fields to flag partial responses
+	var missing uint64
+	defer func() {
+		getCounter(`c5_base_fields_missing{target="` + prefix + `"}`).Set(missing)
+		setParseSuccess(`c5_base_parse_success{target="`+prefix+`"}`, missing == 0)
+	}()
+
 	// Set build version in info string
-	version := parseBuildString(state.BuildVersion)
-	if version == "" { // Workaround for typo in sessionconsole before R6.2
-		version = parseBuildString(state.BuildVersionOld)
+	build := state.BuildVersion
+	version, ok := parseBuildString(build)
+	if !ok && build == "" { // Workaround for typo in sessionconsole before R6.2
+		build = state.BuildVersionOld
+		version, ok = parseBuildString(build)
+	}
+	setBuildStringFormat(prefix, buildStringFormat(build, ok))
+	setBuildVersion(prefix, version)
+	if !ok {
+		logError("Failed to parse build version of", prefix+":", state.BuildVersion+state.BuildVersionOld)
+		setParseWarning(prefix, "buildVersion")
+		missing++
+		if config.AppConfig.StrictBuildVersion {
+			return false
+		}
 	}
-	startupTime := state.StartupTime
-	if startupTime == "" { // Workaround for typo in sessionconsole before R6.2
-		startupTime = state.StartupTimeOld
+	startupTime := state.startupTime()
+	if startupTime == "" {
+		missing++
 	}
 	logInfo("Processed", prefix, version, "started", startupTime)
-	setMetricValue(prefix+`_info{version="`+version+`",starttime="`+startupTime+`"}`, 1)
+	info := prefix + `_info{version="` + version + `",starttime="` + startupTime + `"`
+	if node := targetNode(target); node != "" && !config.AppConfig.NodeLabel {
+		info += `,node="` + node + `"`
+	}
+	setMetricValue(info+`}`, 1)
+	setMetricValue(`c5_`+prefix+`_build_approved`, buildApproved(version))
 
 	// Set process/queue states (usually active=1 or inactive=0)
-	setMetricValue(prefix+`_state`, parseProcessStateString(state.ProxyState, state.QueueState, state.RegistrarState, state.NotificationServerState, state.CstaState))
+	states := state.processStates(daemon)
+	if strings.Join(states, "") == "" {
+		missing++
+		if field, ok := daemonStateFields[daemon]; ok {
+			logError("Missing", field, "of", prefix)
+			setParseWarning(prefix, field)
+		}
+	}
+	processState := parseProcessStateString(states...)
+	setMetricValue(prefix+`_state`, processState)
+	setParseSuccess(`c5_`+prefix+`_up`, processState == 1)
+	if len(config.AppConfig.StandbyStates) > 0 {
+		// Mark standby nodes, so alerts for missing or zero counters can be suppressed
+		setMetricValue(`c5_`+prefix+`_standby`, isStandbyState(states...))
+	}
 	setMetricValue(prefix+`_tu_queue_state`, parseQueueStateString(state.TuQueueStatus))
+	if state.TuQueueStatus == "" {
+		missing++
+	}
 
-	// Set process state (usually active=1 or inactive=0)
+	// Skip memory metrics instead of exporting zeros if the field is missing
+	if strings.TrimSpace(state.MemoryUsage) == "" {
+		logError("Missing memory usage of", prefix)
+		setParseWarning(prefix, "memoryUsage")
+		clearMetrics(prefix + `_memory_`)
+		setMemoryParser(prefix, "none")
+		missing++
+		return true
+	}
+	parser := "string"
 	memUsed, memTotal, memMaxUsage := parseMemoryString(state.MemoryUsage)
+	if config.AppConfig.ValidateMemory {
+		// Detect formats only handled by one of the parsers, the regex wins
+		used, total, maxUsage := parseMemoryStringRegex(state.MemoryUsage)
+		if used != memUsed || total != memTotal || maxUsage != memMaxUsage {
+			logError("Memory parsers disagree for", prefix+":", state.MemoryUsage)
+			getCounter(`c5_memory_parse_mismatch_total{target="` + prefix + `"}`).Inc()
+			memUsed, memTotal, memMaxUsage = used, total, maxUsage
+			parser = "regex"
+		}
+	}
+	if memTotal == 0 {
+		parser = "none"
+		missing++
+	}
+	setMemoryParser(prefix, parser)
 	setMetricValue(prefix+`_memory_used_bytes`, memUsed)
 	setMetricValue(prefix+`_memory_total_bytes`, memTotal)
 	setMetricValue(prefix+`_memory_max_used_percent`, memMaxUsage)
+	if memMaxUsage > 100 {
+		// Keep the raw value, but make the anomaly visible
+		logError("Memory usage for", prefix, "exceeds 100%:", state.MemoryUsage)
+		getCounter(`c5_memory_percent_out_of_range_total{target="` + prefix + `"}`).Inc()
+	}
+	return true
+}
+
+// decodeC5StateResponse decodes a state response. Some command variants
+// return line delimited JSON objects instead of a single document, which
+// are merged: later fields override earlier ones and counters are appended.
+// Fields are decoded from the given JSON keys instead of the default ones.
+func decodeC5StateResponse(r io.Reader, keys map[string]string) (c5state c5StateResponse, err error) {
+	dec := json.NewDecoder(r)
+	var counterInfos []json.RawMessage
+	var alarmedTrapInfos []interface{}
+	var v interface{} = &c5state
+	if len(keys) > 0 {
+		v = &keyedStateResponse{&c5state, keys}
+	}
+	for n := 0; ; n++ {
+		c5state.CounterInfos, c5state.AlarmedTrapInfos = nil, nil
+		err = dec.Decode(v)
+		if err == io.EOF && n > 0 {
+			if n > 1 {
+				logDebug("Merged", n, "line delimited JSON objects")
+			}
+			break
+		} else if err != nil {
+			return c5state, err
+		}
+		counterInfos = append(counterInfos, c5state.CounterInfos...)
+		alarmedTrapInfos = append(alarmedTrapInfos, c5state.AlarmedTrapInfos...)
+	}
+	c5state.CounterInfos, c5state.AlarmedTrapInfos = counterInfos, alarmedTrapInfos
+	return c5state, nil
+}
+
+var verbosityRegex = regexp.MustCompile(`^(-v+|none)$`)
+
+var hostHeaderRegex = regexp.MustCompile(`^(\[[0-9a-fA-F:.]+\]|[a-zA-Z0-9.-]+)(:[0-9]+)?$`)
+
+// withVerbosity replaces the verbosity option of a command like "49&1&-v".
+// The option is removed for "none" and appended if it is missing.
+func withVerbosity(command, verbosity string) string {
+	args := strings.Split(command, "&")
+	if n := len(args) - 1; strings.HasPrefix(args[n], "-v") {
+		args = args[:n]
+	}
+	if verbosity != "none" {
+		args = append(args, verbosity)
+	}
+	return strings.Join(args, "&")
+}
+
+// newTargetRequest creates the HTTP request for querying the given target.
+// GET is used unless another method and/or a body is configured.
+func newTargetRequest(target config.Target) (*http.Request, error) {
+	method := target.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	rawURL, command := target.URL, target.Body
+	if target.Verbosity != "" {
+		if command != "" {
+			command = withVerbosity(command, target.Verbosity)
+		} else {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				return nil, err
+			}
+			u.RawQuery = withVerbosity(u.RawQuery, target.Verbosity)
+			rawURL = u.String()
+		}
+	}
+	var body io.Reader
+	if command != "" {
+		body = strings.NewReader(command)
+	}
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if target.HostHeader != "" {
+		req.Host = target.HostHeader
+	}
+	return req, nil
 }
 
-func fetchC5StateMetrics(prefix, url string, wg *sync.WaitGroup) {
+// fetchC5StateMetrics queries the given target and updates its metrics.
+// Results arriving after ctx is done are dropped, as the scrape has been
+// finished without them.
+func fetchC5StateMetrics(ctx context.Context, target config.Target, wg *sync.WaitGroup) {
 	defer wg.Done()
-	client := http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Get(url)
+	defer trackScrapeGoroutine()()
+	prefix := target.Prefix
+	first, done := beginScrape(prefix, target.URL)
+	if !first {
+		return
+	}
+	defer done()
+	if scrapeDisabled(prefix) {
+		// Drop the metrics of the last query, the outage is expected
+		clearMetrics(prefix)
+		clearScrapeStatus(prefix)
+		return
+	}
+	if throttleScrape(prefix) {
+		return
+	}
+	start := time.Now()
+	success := false
+	var release func()
+	defer func() {
+		// Written holding the output lock, so a query abandoned at the
+		// deadline doesn't expose its status again
+		if release == nil {
+			var ok bool
+			if release, ok = lockScrapeOutput(ctx); !ok {
+				return
+			}
+		}
+		defer release()
+		setScrapeSuccess(prefix, success)
+		setScrapeDuration(target, start)
+	}()
+	transport, err := transportFor(target)
 	if err != nil {
-		logError("Failed to connect", err)
+		logError("Failed to create transport for", prefix, err)
+		setScrapeError(prefix, "proxy")
+		clearMetrics(prefix)
+		return
+	}
+	client := http.Client{Transport: transport}
+	req, err := newTargetRequest(target)
+	if err != nil {
+		logError("Failed to create request for", prefix, err)
+		setScrapeError(prefix, "request")
+		clearMetrics(prefix)
+		return
+	}
+	resp, cancel, err := sendRequest(ctx, &client, req, timeoutFor(target))
+	defer func() { cancel() }()
+	for retry := 1; retry <= config.AppConfig.Retries && err != nil && ctx.Err() == nil && connectErrorReason(err) != "dns"; retry++ {
+		logDebug("Retrying query of", prefix, "after error:", err)
+		getCounter(`c5_scrape_retries_total{target="` + prefix + `"}`).Inc()
+		cancel()
+		if req, err = newTargetRequest(target); err == nil {
+			resp, cancel, err = sendRequest(ctx, &client, req, timeoutFor(target))
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		logDebug("Scrape of", prefix, "aborted:", err)
+		return
+	} else if err != nil {
+		setLastHTTPStatus(prefix, 0)
+		handleConnectError(prefix, err)
 		clearMetrics(prefix)
 		return
 	}
 	defer resp.Body.Close()
-	var c5state c5StateResponse
+	setLastHTTPStatus(prefix, resp.StatusCode)
+	setResponseContentType(prefix, resp.Header.Get("Content-Type"))
+	if !checkHTTPStatus(prefix, resp) {
+		clearMetrics(prefix)
+		return
+	}
 	// logDebug("Parsing response body", resp.Body)
-	err = json.NewDecoder(resp.Body).Decode(&c5state)
-	if err != nil {
+	decoded := measureAllocs(prefix, "decode")
+	processes := []config.Target{target}
+	states := make([]c5StateResponse, 1)
+	if target.Bundle {
+		processes, states, err = decodeC5Bundle(resp.Body, target)
+	} else {
+		states[0], err = decodeC5StateResponse(resp.Body, responseKeys(target.Daemon))
+	}
+	decoded()
+	if err != nil && ctx.Err() != nil {
+		logDebug("Scrape of", prefix, "aborted:", err)
+		return
+	} else if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		logError("Timeout reading response of", prefix+":", err)
+		setScrapeError(prefix, "timeout")
+		clearMetrics(prefix)
+		return
+	} else if err != nil {
 		logError("Failed to parse response, err: ", err)
+		setScrapeError(prefix, "parse")
 		clearMetrics(prefix)
 		return
 	}
+	release, ok := lockScrapeOutput(ctx)
+	if !ok {
+		logDebug("Dropping late response of", prefix)
+		return
+	}
+	received := time.Now()
+	if target.Bundle {
+		forgetVanishedProcesses(prefix, processes)
+	}
+	for i, process := range processes {
+		if !processStateResponse(process, states[i]) {
+			setScrapeError(prefix, "buildVersion")
+			clearMetrics(prefix)
+			return
+		}
+	}
+	success = true
+	setScrapedAt(prefix, received)
+}
+
+// processStateResponse sets the metrics of a state response. It returns false
+// if the response must be treated as failed scrape.
+func processStateResponse(target config.Target, c5state c5StateResponse) bool {
+	prefix := target.Prefix
+	// Number of raw elements as tripwire for truncated or changed responses
+	getCounter(`c5_counterinfos_elements{target="` + prefix + `"}`).Set(uint64(len(c5state.CounterInfos)))
+
 	// process base information
-	processBaseMetrics(prefix, c5state)
+	if !processBaseMetrics(target, c5state) {
+		return false
+	}
+
+	// Skip the counters in lightweight mode
+	if config.AppConfig.BaseOnly || target.BaseOnly {
+		return true
+	}
 
 	// process event and usage counters now
-	processC5StateCounter(prefix, c5state.CounterInfos)
+	processed := measureAllocs(prefix, "counters")
+	stats := processC5StateCounter(prefix, target.Daemon, c5state.CounterInfos)
+	processed()
+	trackVanishedCounters(prefix, c5state.startupTime(), stats.names)
+	return true
+}
+
+// decodeC5Bundle decodes the state responses of several C5 processes bundled
+// by a management layer into a single document keyed by process name:
+//
+//	{ "sipproxyd" : { "proxyState" : "active", ... }, "acdqueued" : { ... } }
+//
+// It returns a target per process with the name appended to the prefix of the
+// bundle. Known process names also select the expected state field.
+func decodeC5Bundle(r io.Reader, bundle config.Target) ([]config.Target, []c5StateResponse, error) {
+	var responses map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&responses); err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(responses))
+	for name := range responses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	processes := make([]config.Target, 0, len(names))
+	states := make([]c5StateResponse, 0, len(names))
+	for _, name := range names {
+		if !prefixRegex.MatchString(name) {
+			return nil, nil, fmt.Errorf("invalid process name %q in bundle", name)
+		}
+		process := bundle
+		process.Prefix, process.Bundle, process.Daemon = bundle.Prefix+"_"+name, false, ""
+		if _, ok := daemonStateFields[name]; ok {
+			process.Daemon = name
+		}
+		state, err := decodeC5StateResponse(bytes.NewReader(responses[name]), responseKeys(process.Daemon))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		processes = append(processes, process)
+		states = append(states, state)
+	}
+	return processes, states, nil
 }
 
 func fetchC5CounterMetrics(prefix, url string, wg *sync.WaitGroup) {
 	defer wg.Done()
-	client := http.Client{Timeout: 2 * time.Second}
+	defer trackScrapeGoroutine()()
+	first, done := beginScrape(prefix, url)
+	if !first {
+		return
+	}
+	defer done()
+	client := http.Client{Timeout: timeoutFor(config.Target{}), Transport: c5Transport}
 	resp, err := client.Get(url)
 	if err != nil {
-		logError("Failed to connect", err)
+		handleConnectError(prefix, err)
 		clearMetrics(prefix)
 		return
 	}
 	defer resp.Body.Close()
+	if !checkHTTPStatus(prefix, resp) {
+		clearMetrics(prefix)
+		return
+	}
 	var c5Resp c5CounterResponse
 	// logDebug("Parsing response body", resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&c5Resp)
 	if err != nil {
 		logError("Failed to parse response, err: ", err)
+		setScrapeError(prefix, "parse")
 		clearMetrics(prefix)
 		return
 	}
@@ -542,6 +2126,18 @@ func fetchC5CounterMetrics(prefix, url string, wg *sync.WaitGroup) {
 	processC5CounterMetrics(prefix, c5Resp)
 }
 
+// newC5Transport creates the HTTP transport used to query the C5 processes.
+// Keep-alive is enabled by default, but may be disabled for environments
+// where firewalls drop idle connections. HTTP/2 is used for HTTPS URLs
+// negotiating it unless disabled, plain HTTP always uses HTTP/1.1.
+func newC5Transport(conf *config.AppConfiguration) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DisableKeepAlives = conf.DisableKeepAlive
+	tr.ForceAttemptHTTP2 = !conf.DisableHTTP2
+	tr.DialContext = withConnectTimeout(tr.DialContext, conf.ConnectTimeout.Duration)
+	return tr
+}
+
 // ---------------------------- XML struct For XMS REST API
 
 type WebService struct {
@@ -585,6 +2181,12 @@ type Resource struct {
 func fetchXmsMetrics(prefix, url string, user string, pwd string, wg *sync.WaitGroup) {
 	logDebug("fetchXmsMetrics with prefix ", prefix, "from url", url)
 	defer wg.Done()
+	defer trackScrapeGoroutine()()
+	first, done := beginScrape(prefix, url)
+	if !first {
+		return
+	}
+	defer done()
 	// Disable of certificate checks required for XMS in case HTTPS is used
 	// Failed to connect Get "https://127.0.0.1:10443/resource/counters":
 	//   x509: cannot validate certificate for XMS because it doesn't contain any IP SANs
@@ -592,7 +2194,7 @@ func fetchXmsMetrics(prefix, url string, user string, pwd string, wg *sync.WaitG
 		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 		DisableKeepAlives: true,
 	}
-	client := http.Client{Timeout: 2 * time.Second, Transport: tr}
+	client := http.Client{Timeout: config.AppConfig.Timeout.Duration, Transport: tr}
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -603,11 +2205,18 @@ func fetchXmsMetrics(prefix, url string, user string, pwd string, wg *sync.WaitG
 	// Make request and show output
 	resp, err := client.Do(req)
 	if err != nil {
-		logError("Failed to connect", err)
+		setLastHTTPStatus(prefix, 0)
+		handleConnectError(prefix, err)
 		clearMetrics(prefix)
 		return
 	}
 	defer resp.Body.Close()
+	setLastHTTPStatus(prefix, resp.StatusCode)
+	setResponseContentType(prefix, resp.Header.Get("Content-Type"))
+	if !checkHTTPStatus(prefix, resp) {
+		clearMetrics(prefix)
+		return
+	}
 
 	// activate struct for xml
 	var webService WebService
@@ -617,6 +2226,7 @@ func fetchXmsMetrics(prefix, url string, user string, pwd string, wg *sync.WaitG
 
 	if err != nil {
 		logError("Failed to parse response for prefix", prefix, " with error:", err)
+		setScrapeError(prefix, "parse")
 		clearMetrics(prefix)
 		return
 	}
@@ -670,25 +2280,86 @@ func main() {
 
 	// Define and parse commandline flags for initial configuration
 	configFile := flag.String("config", "", "Configuration file to load")
+	selftest := flag.Bool("selftest", false, "Run the parser over embedded sample responses and exit")
 	flag.BoolVar(&conf.Debug, "debug", false, "Enable debug")
-	flag.StringVar(&conf.ListenAddress, "listen", ":9055", "Listen address")
+	flag.StringVar(&conf.ListenAddress, "listen", ":9055", "Listen address, or comma separated list of addresses")
+	flag.StringVar(&conf.AdminListenAddress, "admin-listen", "", "Comma separated list of listen addresses for debug endpoints, disabled if empty")
+	flag.BoolVar(&conf.Pprof, "pprof", false, "Serve pprof profiling endpoints on the admin listener")
+	flag.BoolVar(&conf.SumSubUsageCounters, "sum-sub-usage-counters", false, "Also export the sum of the current values of multi-line usage counters without idx label")
+	flag.IntVar(&conf.ErrorLogLimit, "error-log-limit", 0, "Maximum number of identical error messages logged per minute, unlimited if 0")
+	flag.StringVar(&conf.CounterSections, "counter-sections", "", "Export section names of the counter tables in the metric name or as label, either name or label")
+	flag.BoolVar(&conf.PreserveCounterCase, "preserve-counter-case", false, "Keep the case of C5 counter names in metric names instead of lowercasing them")
+	flag.BoolVar(&conf.Warmup, "warmup", false, "Query all processes once on startup before serving metrics")
+	flag.BoolVar(&conf.CardinalityReport, "cardinality-report", false, "Serve the series count per metric of a target on the admin listener")
+	flag.BoolVar(&conf.DisableKeepAlive, "disable-keepalive", false, "Disable HTTP keep-alive for C5 queries")
+	flag.BoolVar(&conf.DisableHTTP2, "disable-http2", false, "Use HTTP/1.1 for C5 queries also if HTTPS endpoints support HTTP/2")
+	flag.BoolVar(&conf.Verbose, "verbose", false, "Enable additional parser metrics for profiling")
+	flag.BoolVar(&conf.ProfileAllocations, "profile-allocations", false, "Expose the bytes allocated while parsing each C5 response, parsing one response at a time")
+	flag.BoolVar(&conf.ValidateMemory, "validate-memory", false, "Compare the results of both memory usage parsers")
+	flag.BoolVar(&conf.StrictBuildVersion, "strict-build-version", false, "Fail scrapes of processes with invalid build version")
+	flag.BoolVar(&conf.CounterDetails, "counter-details", false, "Parse counters with nested details, exporting their thresholds")
+	flag.BoolVar(&conf.BaseOnly, "base-only", false, "Only export state, memory and version metrics, skipping all counters")
+	flag.BoolVar(&conf.SampleTimestamps, "sample-timestamps", false, "Add the time of the last successful query of each C5 process to its samples")
+	flag.StringVar(&conf.CounterDefinitions, "counter-definitions", "", "CSV file of counter descriptions and units exported as HELP lines")
+	flag.BoolVar(&conf.KeepOldCounterTypes, "keep-old-counter-types", false, "Also export counters with type override under their previous names (transitional, to be removed in v2.0)")
+	flag.BoolVar(&conf.NodeLabel, "node-label", false, "Add a node label with the C5 host to all metrics of a process")
+	flag.BoolVar(&conf.ExporterInstanceLabel, "exporter-instance-label", false, "Add an exporter_instance label to all metrics")
+	flag.StringVar(&conf.ExporterInstance, "exporter-instance", "", "Value of the exporter_instance label (default hostname)")
+	flag.StringVar(&conf.ReadyTargets, "ready-targets", "all", "Targets required to be scraped once for /-/ready: all or any")
+	flag.IntVar(&conf.ScrapeParallelism, "scrape-parallelism", 0, "Number of C5 processes queried at once (default GOMAXPROCS)")
+	flag.IntVar(&conf.Retries, "retries", 0, "Number of retries of failed C5 queries")
+	flag.StringVar(&conf.AverageRounding, "average-rounding", "", "Rounding of fractional averages: round, floor, ceil or none (default none)")
+	flag.IntVar(&conf.MaxSeriesPerTarget, "max-series-per-target", 0, "Maximum number of series registered per C5 process (default unlimited)")
+	flag.StringVar(&conf.IdxLabel, "idx-label", "idx", "Label key of the line index of multi-line counters")
+	flag.IntVar(&conf.MaxSubUsageLines, "max-sub-usage-lines", 0, "Maximum number of continuation lines parsed per usage counter (default 1024)")
+	flag.Var(&conf.Timeout, "timeout", "Timeout for C5 and XMS queries (default 2s)")
+	flag.Var(&conf.ConnectTimeout, "connect-timeout", "Timeout for connecting to C5 processes, only limited by the request timeout if not set")
+	flag.Var(&conf.RequestTimeout, "request-timeout", "Timeout for C5 queries including reading the response, overrides -timeout if set")
+	flag.Var(&conf.ValidateOutputInterval, "validate-output-interval", "Interval of validating the exposed metrics, disabled if zero")
+	flag.Var(&conf.MinScrapeInterval, "min-scrape-interval", "Minimum interval between queries of a C5 process, serving the last metrics meanwhile")
+	flag.StringVar(&addressFlags.host, "host", "", "Host address of the C5 processes, adjusts the configured URLs")
+	flag.IntVar(&addressFlags.sipproxydPort, "sipproxyd-port", 0, "Port of sipproxyd, adjusts the configured URLs")
+	flag.IntVar(&addressFlags.acdqueuedPort, "acdqueued-port", 0, "Port of acdqueued, adjusts the configured URL")
+	flag.IntVar(&addressFlags.registrardPort, "registrard-port", 0, "Port of registrard, adjusts the configured URL")
 	flag.Parse()
 
 	if conf.Debug {
 		logInfo("Enabled debug logging")
 	}
 
+	if *selftest {
+		if !runSelftest() {
+			log.Fatal("Self-test failed")
+		}
+		logInfo("Self-test passed")
+		return
+	}
+
+	metricSet = metrics.NewSet()
+
 	if configFile != nil && *configFile != "" {
 		logInfo("Loading configuration", *configFile)
-		err := configor.New(&configor.Config{Debug: conf.Debug}).Load(conf, *configFile)
+		files, err := configFiles(*configFile)
+		if err != nil {
+			log.Fatal("Unable to load configuration ", *configFile, ": ", err)
+		}
+		err = loadConfiguration(conf, files)
 		if err != nil {
-			log.Fatal("Unable to load configuration", *configFile, err)
+			log.Fatal("Unable to load configuration ", *configFile, ": ", err)
 		}
+		setConfigMtime(files)
+		setConfigLoaded(time.Now())
 
 		// Reparse commandline flags to override loaded config parameters
 		flag.Parse()
 	} else {
 		logInfo("No configuration file used. Enabling querying of all C5 and XMS processes.")
+		// Apply defaults of the configuration
+		err := loadConfiguration(conf, nil)
+		if err != nil {
+			log.Fatal("Unable to apply default configuration: ", err)
+		}
+		flag.Parse()
 		conf.XmsEnabled = true
 		conf.SIPProxydEnabled = true
 		conf.ACDQueuedEnabled = true
@@ -697,62 +2368,310 @@ func main() {
 		conf.CstaEnabled = true
 	}
 
-	if !(conf.SIPProxydEnabled || conf.SIPProxydTrunksEnabled || conf.ACDQueuedEnabled || conf.RegistrardEnabled || conf.NotificationEnabled || conf.CstaEnabled || conf.XmsEnabled) {
+	if err := applyAddressFlags(conf); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := validateCounterTypes(conf); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := validateUsageColumns(conf); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := validateMetricRenames(conf); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if l := conf.IdxLabel; !prefixRegex.MatchString(l) || strings.HasPrefix(l, "__") {
+		log.Fatal("Invalid configuration: idxLabel must be a valid label name, not ", l)
+	}
+	switch conf.AverageRounding {
+	case "", "none", "round", "floor", "ceil":
+	default:
+		log.Fatal("Invalid configuration: averageRounding must be round, floor, ceil or none, not ", conf.AverageRounding)
+	}
+	if r := conf.ReadyTargets; r != "all" && r != "any" {
+		log.Fatal("Invalid configuration: readyTargets must be all or any, not ", r)
+	}
+	if m := conf.CounterSections; m != "" && m != "name" && m != "label" {
+		log.Fatal("Invalid configuration: counterSections must be name or label, not ", m)
+	}
+	if m := conf.EventCounterDeltas; m != "" && m != "alongside" && m != "instead" {
+		log.Fatal("Invalid configuration: eventCounterDeltas must be alongside or instead, not ", m)
+	}
+	if err := validateResponseKeys(conf.ResponseKeys); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	list, err := buildTargets(conf)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	setTargets(list)
+	setTimeoutMetrics()
+
+	listenAddresses, err := parseListenAddresses(conf.ListenAddress)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	var adminAddresses []string
+	if conf.AdminListenAddress != "" {
+		adminAddresses, err = parseListenAddresses(conf.AdminListenAddress)
+		if err != nil {
+			log.Fatal("Invalid configuration: admin listener: ", err)
+		}
+	}
+	if conf.Pprof && conf.AdminListenAddress == "" {
+		log.Fatal("Invalid configuration: pprof requires an admin listen address")
+	}
+	if conf.CardinalityReport && conf.AdminListenAddress == "" {
+		log.Fatal("Invalid configuration: cardinality report requires an admin listen address")
+	}
+	if !(len(list) > 0 || conf.SIPProxydTrunksEnabled || conf.XmsEnabled) {
 		logError("No c5 or XMS processes enabled to query. Please enable at least on process in configuration.")
 		log.Fatal("Aborting.")
 	}
+	if conf.ExporterInstanceLabel && conf.ExporterInstance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Unable to determine exporter instance: ", err)
+		}
+		conf.ExporterInstance = hostname
+	}
 	logConfig()
 
-	metricSet = metrics.NewSet()
+	if conf.CounterDefinitions != "" {
+		defs, err := loadCounterDefinitions(conf.CounterDefinitions)
+		if err != nil {
+			log.Fatal("Invalid configuration: ", err)
+		}
+		setCounterDefinitions(defs)
+		logInfo("Loaded", len(defs), "counter definitions from", conf.CounterDefinitions)
+	}
+
+	// Reload targets and counter definitions on SIGHUP
+	if *configFile != "" || conf.CounterDefinitions != "" {
+		go func() {
+			sighup := make(chan os.Signal, 1)
+			signal.Notify(sighup, syscall.SIGHUP)
+			for range sighup {
+				if *configFile != "" {
+					reloadTargets(*configFile)
+				}
+				if conf.CounterDefinitions != "" {
+					reloadCounterDefinitions(conf.CounterDefinitions)
+				}
+			}
+		}()
+	}
+
+	c5Transport = newC5Transport(conf)
+
+	if conf.InfluxURL != "" {
+		if conf.InfluxInterval.Duration <= 0 {
+			log.Fatal("Invalid configuration: influxInterval must be positive")
+		}
+		go runInfluxPush(conf)
+	}
+	if conf.ValidateOutputInterval.Duration > 0 {
+		go runOutputValidation(conf.ValidateOutputInterval.Duration)
+	}
+
+	// Open all listeners before the warmup to fail fast on a used address
+	listeners, err := listenAll(listenAddresses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	adminListeners, err := listenAll(adminAddresses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.Warmup {
+		warmup()
+	}
+	// logInfo(fmt.Printf("Starting c5exporter v%s on port %s", version, conf.ListenAddress))
+	logInfo("Starting c5exporter version", version, "on", strings.Join(listenAddresses, ", "))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serve debug endpoints on a separate listener only. A failure of either
+	// listener shuts down both.
+	adminDone := make(chan error, 1)
+	if len(adminListeners) > 0 {
+		logInfo("Starting admin listener on", strings.Join(adminAddresses, ", "))
+		go func() {
+			adminDone <- serveAll(ctx, adminListeners, newAdminHandler())
+			stop()
+		}()
+	} else {
+		adminDone <- nil
+	}
+	err = serveAll(ctx, listeners, newMetricsHandler())
+	stop()
+	if adminErr := <-adminDone; err == nil {
+		err = adminErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logInfo("Stopped c5exporter")
+}
 
+// newMetricsHandler returns the handler of the public listener. A separate
+// mux is used, so debug handlers registered on the default mux by imported
+// packages like net/http/pprof are never exposed.
+func newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
 	// Expose the registered metrics at `/metrics` path.
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
-		var wg sync.WaitGroup
-		// --- XMS5 Metrics
-		if conf.XmsEnabled {
-			wg.Add(2)
-			go fetchXmsMetrics("xms_counter", conf.XmsCountersURL, conf.XmsUser, conf.XmsPwd, &wg)
-			go fetchXmsMetrics("xms_license", conf.XmsLicensesURL, conf.XmsUser, conf.XmsPwd, &wg)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), scrapeDeadline())
+		defer cancel()
+		scrapeAll(ctx)
+		serveMetrics(w, req)
+	})
+	// Expose the same metrics as JSON for tools not parsing the text format
+	mux.HandleFunc("/metrics/json", func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), scrapeDeadline())
+		defer cancel()
+		scrapeAll(ctx)
+		var buf bytes.Buffer
+		writeMetrics(&buf)
+		w.Header().Set("Content-Type", "application/json")
+		if err := writeJSONMetrics(w, buf.Bytes()); err != nil {
+			logError("Failed to write JSON metrics:", err)
 		}
-		// --- C5 Metrics
-		if conf.SIPProxydEnabled {
-			wg.Add(1)
-			go fetchC5StateMetrics("sipproxyd", conf.SIPProxydURL, &wg)
+	})
+	mux.HandleFunc("/-/ready", handleReady)
+	return mux
+}
+
+// serveMetrics writes the current metrics as response to the /metrics
+// request, compressed if supported by the client.
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		writeMetrics(w)
+		return
+	}
+	// Compress large outputs if supported, like by Prometheus
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Vary", "Accept-Encoding")
+	gz := gzip.NewWriter(w)
+	writeMetrics(gz)
+	if err := gz.Close(); err != nil {
+		logError("Failed to write compressed metrics:", err)
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header accepts gzip, either
+// explicitly or by "*", with a quality above 0
+func acceptsGzip(header string) bool {
+	accepted := map[string]bool{}
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		ok := true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
 		}
-		if conf.ACDQueuedEnabled {
-			wg.Add(1)
-			go fetchC5StateMetrics("acdqueued", conf.ACDQueuedURL, &wg)
+		accepted[name] = ok
+	}
+	if ok, found := accepted["gzip"]; found {
+		return ok
+	}
+	return accepted["*"]
+}
+
+// handleReady reports the exporter as ready once all targets, or any with
+// readyTargets = "any", have been scraped and parsed successfully. Targets
+// not succeeded yet are queried, as scrapes may only be routed to ready
+// instances. Otherwise 503 is returned listing the failing targets.
+// Temporarily disabled targets are ignored.
+func handleReady(w http.ResponseWriter, req *http.Request) {
+	var list, pending []config.Target
+	for _, t := range currentTargets() {
+		if scrapeDisabled(t.Prefix) {
+			continue
 		}
-		if conf.RegistrardEnabled {
-			wg.Add(1)
-			go fetchC5StateMetrics("registrard", conf.RegistrardURL, &wg)
+		list = append(list, t)
+		if !targetSucceeded(t.Prefix) {
+			pending = append(pending, t)
 		}
-		if conf.NotificationEnabled {
-			wg.Add(1)
-			go fetchC5StateMetrics("notification", conf.NotificationURL, &wg)
+	}
+	if len(pending) > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), scrapeDeadline())
+		scrapeTargets(ctx, pending, scrapeParallelism())
+		cancel()
+	}
+	var failing []string
+	for _, t := range list {
+		if !targetSucceeded(t.Prefix) {
+			failing = append(failing, t.Prefix)
 		}
-		if conf.CstaEnabled {
-			wg.Add(1)
-			go fetchC5StateMetrics("cstagwd", conf.CstaURL, &wg)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ready := len(failing) == 0
+	if config.AppConfig.ReadyTargets == "any" {
+		ready = len(failing) < len(list) || len(list) == 0
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, prefix := range failing {
+			fmt.Fprintln(w, prefix, "not scraped successfully")
 		}
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
 
-		wg.Wait()
-		// We need to ensure sequential processing, so wait between fetches
-		if conf.SIPProxydTrunksEnabled {
-			wg.Add(1)
-			go fetchC5CounterMetrics("sipproxyd", conf.SIPProxydTrunkStatsURL, &wg)
-			wg.Wait()
-			wg.Add(1)
-			go fetchC5CounterMetrics("sipproxyd", conf.SIPProxydTrunkLimitsURL, &wg)
-			wg.Wait()
-		}
-		metricSet.WritePrometheus(w)
-		metrics.WriteProcessMetrics(w)
-	})
+// warmup queries all processes once before the metrics are served, so the
+// first pull finds them populated and connections already established. It
+// returns after the scrape deadline at the latest, unreachable targets do not
+// delay the startup any longer.
+func warmup() {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeDeadline())
+	defer cancel()
+	scrapeAll(ctx)
+	logInfo("Warmup scrape finished after", time.Since(start).Round(time.Millisecond))
+}
 
-	// logInfo(fmt.Printf("Starting c5exporter v%s on port %s", version, conf.ListenAddress))
-	logInfo("Starting c5exporter version", version, "on", conf.ListenAddress)
-	log.Fatal(http.ListenAndServe(conf.ListenAddress, nil))
+// scrapeAll queries all enabled C5 and XMS processes and updates the metric set
+func scrapeAll(ctx context.Context) {
+	conf := config.AppConfig
+	var wg sync.WaitGroup
+	list := currentTargets()
+	scraped := len(list)
+	// --- XMS5 Metrics
+	if conf.XmsEnabled {
+		wg.Add(2)
+		go fetchXmsMetrics("xms_counter", conf.XmsCountersURL, conf.XmsUser, conf.XmsPwd, &wg)
+		go fetchXmsMetrics("xms_license", conf.XmsLicensesURL, conf.XmsUser, conf.XmsPwd, &wg)
+		scraped += 2
+	}
+	// --- C5 Metrics
+	// Time blocked waiting for the slowest target, e.g. to tune timeouts
+	start := time.Now()
+	scrapeTargets(ctx, list, scrapeParallelism())
+
+	wg.Wait()
+	getFloatCounter(`c5_handler_wait_seconds`).Set(time.Since(start).Seconds())
+	// We need to ensure sequential processing, so wait between fetches
+	if conf.SIPProxydTrunksEnabled && !conf.BaseOnly {
+		wg.Add(1)
+		go fetchC5CounterMetrics("sipproxyd", conf.SIPProxydTrunkStatsURL, &wg)
+		wg.Wait()
+		wg.Add(1)
+		go fetchC5CounterMetrics("sipproxyd", conf.SIPProxydTrunkLimitsURL, &wg)
+		wg.Wait()
+	}
+	// Number of targets queried for this output, to verify the configuration
+	getCounter(`c5_scrape_targets_count`).Set(uint64(scraped))
+	setConfigAge()
+	setBuildsSeen()
+	// Number of series in the set to watch for cardinality growth
+	registered := getCounter(`c5_registered_metrics`)
+	registered.Set(uint64(len(metricSet.ListMetricNames())))
 }
 
 func logInfo(msg ...interface{}) {
@@ -765,33 +2684,72 @@ func logDebug(msg ...interface{}) {
 	}
 }
 
+// Interval identical error messages are limited per
+const errorLogWindow = time.Minute
+
+var (
+	errorLogMu         sync.Mutex
+	errorLogStart      time.Time      // Start of the current window
+	errorLogCounts     map[string]int // Number of occurrences per message within the window
+	errorLogSuppressed int            // Number of messages not logged within the window
+)
+
+// logError logs an error unless the same message has been logged
+// errorLogLimit times within the last minute already. The number of
+// suppressed messages is logged once the minute is over.
 func logError(msg ...interface{}) {
-	log.Print("[ERROR] ", fmt.Sprintln(msg...))
+	text := fmt.Sprintln(msg...)
+	limit := config.AppConfig.ErrorLogLimit
+	if limit <= 0 {
+		log.Print("[ERROR] ", text)
+		return
+	}
+	errorLogMu.Lock()
+	defer errorLogMu.Unlock()
+	if now := time.Now(); now.Sub(errorLogStart) >= errorLogWindow {
+		if errorLogSuppressed > 0 {
+			log.Print("[ERROR] ", fmt.Sprintln("Suppressed", errorLogSuppressed, "repeated error messages since", errorLogStart.Format(time.RFC3339)))
+		}
+		errorLogStart, errorLogCounts, errorLogSuppressed = now, map[string]int{}, 0
+	}
+	errorLogCounts[text]++
+	if errorLogCounts[text] > limit {
+		errorLogSuppressed++
+		getCounter(`c5_log_errors_suppressed_total`).Inc()
+		return
+	}
+	log.Print("[ERROR] ", text)
 }
 
 func logConfig() {
 	conf := config.AppConfig
-	logDebug(fmt.Sprintf("Using configuration: %+v", conf))
-	if conf.SIPProxydEnabled {
-		logInfo("sipproxyd enabled with url", conf.SIPProxydURL)
+	logDebug(fmt.Sprintf("Using configuration: %+v", redactConfig(conf)))
+	logInfo("Using timeout", timeoutFor(config.Target{}).String())
+	if conf.ConnectTimeout.Duration > 0 {
+		logInfo("Using connect timeout", conf.ConnectTimeout)
+	}
+	if conf.MinScrapeInterval.Duration > 0 {
+		logInfo("Using minimum scrape interval", conf.MinScrapeInterval)
 	}
-	if conf.ACDQueuedEnabled {
-		logInfo("acdqueued enabled with url", conf.ACDQueuedURL)
+	logInfo("Querying up to", scrapeParallelism(), "C5 processes at once")
+	if conf.BaseOnly {
+		logInfo("Only base metrics enabled, skipping all counters")
 	}
-	if conf.RegistrardEnabled {
-		logInfo("registrard enabled with url", conf.RegistrardURL)
+	if conf.DisableKeepAlive {
+		logInfo("keep-alive disabled for C5 queries")
 	}
+	if conf.DisableHTTP2 {
+		logInfo("HTTP/2 disabled for C5 queries")
+	}
+	if conf.ExporterInstanceLabel {
+		logInfo("Adding label exporter_instance", conf.ExporterInstance)
+	}
+	logTargets()
 	if conf.SIPProxydTrunksEnabled {
 		logInfo("sipproxyd trunks enabled with:")
 		logInfo("- stats url:", conf.SIPProxydTrunkStatsURL)
 		logInfo("- limits url:", conf.SIPProxydTrunkLimitsURL)
 	}
-	if conf.NotificationEnabled {
-		logDebug("notification-server enabled with url:", conf.NotificationURL)
-	}
-	if conf.CstaEnabled {
-		logDebug("cstagwd enabled with url:", conf.CstaURL)
-	}
 	if conf.XmsEnabled {
 		logInfo("xms enabled with user", conf.XmsUser)
 		logInfo("- counters url:", conf.XmsCountersURL)
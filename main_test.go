@@ -1,9 +1,133 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
 
 const mega = 1024 * 1024
 
+func TestMain(m *testing.M) {
+	metricSet = metrics.NewSet()
+	c5Transport = newC5Transport(config.AppConfig)
+	os.Exit(m.Run())
+}
+
+func Test_buildMetricName(t *testing.T) {
+	idx := 2
+	tests := []struct {
+		name     string
+		idxLabel string
+		sections string
+		idx      *int
+		want     string
+	}{
+		{"single line", "", "", nil, "sipproxyd_queue_size_lastmax"},
+		{"default", "", "", &idx, `sipproxyd_queue_size_lastmax{idx="2"}`},
+		{"custom", "index", "", &idx, `sipproxyd_queue_size_lastmax{index="2"}`},
+		{"section name", "", "name", &idx, `sipproxyd_transport_layer_queue_size_lastmax{idx="2"}`},
+		{"section label", "", "label", nil, `sipproxyd_queue_size_lastmax{section="transport_layer"}`},
+		{"section label with idx", "Index", "label", &idx, `sipproxyd_queue_size_lastmax{section="transport_layer",Index="2"}`},
+	}
+	defer func() { config.AppConfig.IdxLabel, config.AppConfig.CounterSections = "", "" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.IdxLabel, config.AppConfig.CounterSections = tt.idxLabel, tt.sections
+			if got := buildMetricName("sipproxyd", "Transport_Layer", "QUEUE_SIZE_LASTMAX", tt.idx); got != tt.want {
+				t.Errorf("buildMetricName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildMetricNameCase(t *testing.T) {
+	defer func() { config.AppConfig.PreserveCounterCase = false }()
+	tests := []struct {
+		name     string
+		counter  string
+		preserve bool
+		want     string
+	}{
+		{"lowercased", "CALL_CONTROL_ACTIVE_CALLS_current", false, "sipproxyd_call_control_active_calls_current"},
+		{"preserved", "CALL_CONTROL_ACTIVE_CALLS_current", true, "sipproxyd_CALL_CONTROL_ACTIVE_CALLS_current"},
+		{"mixed case preserved", "Sip_Trunk_Calls_current", true, "sipproxyd_Sip_Trunk_Calls_current"},
+		{"invalid characters lowercased", "QUEUE-SIZE.REINJECT_current", false, "sipproxyd_queue_size_reinject_current"},
+		{"invalid characters preserved", "QUEUE-SIZE.REINJECT_current", true, "sipproxyd_QUEUE_SIZE_REINJECT_current"},
+		{"labels lowercased", `trunk_current{name="Trunk1.Example.com"}`, false, `sipproxyd_trunk_current{name="trunk1.example.com"}`},
+		{"labels preserved", `trunk_current{name="Trunk1.Example.com"}`, true, `sipproxyd_trunk_current{name="Trunk1.Example.com"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.PreserveCounterCase = tt.preserve
+			if got := buildMetricName("sipproxyd", "", tt.counter, nil); got != tt.want {
+				t.Errorf("buildMetricName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_processC5StateCounterPreserveCase(t *testing.T) {
+	defer func() { config.AppConfig.PreserveCounterCase = false }()
+	lines := counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		[]interface{}{
+			" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          1      0      3      0      9      0",
+			"                                                      2      0      3      0      4      0",
+		},
+	)
+	tests := []struct {
+		preserve bool
+		want     []string
+	}{
+		{false, []string{
+			"test_case_transaction_and_tu_tu_manager_queue_size_current{idx=\"1\"}",
+			"test_case_transport_message_in_total",
+		}},
+		{true, []string{
+			"test_case_TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE_current{idx=\"1\"}",
+			"test_case_TRANSPORT_MESSAGE_IN_total",
+		}},
+	}
+	for _, tt := range tests {
+		config.AppConfig.PreserveCounterCase = tt.preserve
+		clearMetrics("test_case")
+		processC5StateCounter("test_case", "", lines)
+		registered := map[string]bool{}
+		for _, name := range metricSet.ListMetricNames() {
+			registered[name] = true
+		}
+		for _, name := range tt.want {
+			if !registered[name] {
+				t.Errorf("processC5StateCounter() with preserveCounterCase = %v did not export %s", tt.preserve, name)
+			}
+		}
+	}
+	clearMetrics("test_case")
+}
+
 func Test_parseMemoryString(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -14,6 +138,7 @@ func Test_parseMemoryString(t *testing.T) {
 	}{
 		{"R6.0", "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793", 383 * mega, 2048 * mega, 18},
 		{"R6.2", "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205", 76 * mega, 2048 * mega, 3},
+		{"Max150", "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 150% - UpdCtr: 60793", 383 * mega, 2048 * mega, 150},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -41,6 +166,7 @@ func Test_parseMemoryStringRegex(t *testing.T) {
 	}{
 		{"R6.0", "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793", 383 * mega, 2048 * mega, 18},
 		{"R6.2", "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205", 76 * mega, 2048 * mega, 3},
+		{"Max150", "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 150% - UpdCtr: 60793", 383 * mega, 2048 * mega, 150},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -58,6 +184,44 @@ func Test_parseMemoryStringRegex(t *testing.T) {
 	}
 }
 
+func Test_parseMemoryStringMaxCase(t *testing.T) {
+	formats := map[string]string{
+		"R6.0": "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - KEY 18% - UpdCtr: 60793",
+		"R6.2": "C5 Heap Health: OK  - Mem used: 18%  383MB  (min: 76 max: 76)  - Mem total: 2048MB  - KEY 18% - UpdCtr: 92205",
+	}
+	parsers := map[string]func(string) (uint64, uint64, uint64){
+		"parseMemoryString":      parseMemoryString,
+		"parseMemoryStringRegex": parseMemoryStringRegex,
+	}
+	for format, memoryUsage := range formats {
+		for _, key := range []string{"Max:", "MAX:", "max:"} {
+			for name, parse := range parsers {
+				gotMemUsed, gotMemTotal, gotMemMaxUsage := parse(strings.Replace(memoryUsage, "KEY", key, 1))
+				if gotMemUsed != 383*mega || gotMemTotal != 2048*mega || gotMemMaxUsage != 18 {
+					t.Errorf("%s() of %s with %q = %v, %v, %v, want %v, %v, 18", name, format, key, gotMemUsed, gotMemTotal, gotMemMaxUsage, 383*mega, 2048*mega)
+				}
+			}
+		}
+	}
+}
+
+func Test_processBaseMetricsPercentOutOfRange(t *testing.T) {
+	name := `c5_memory_percent_out_of_range_total{target="test_percent"}`
+	state := c5StateResponse{MemoryUsage: "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205"}
+	processBaseMetrics(config.Target{Prefix: "test_percent"}, state)
+	if got := metricSet.GetOrCreateCounter(name).Get(); got != 0 {
+		t.Errorf("processBaseMetrics() out of range counter = %v, want 0", got)
+	}
+	state.MemoryUsage = "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 150% - UpdCtr: 92205"
+	processBaseMetrics(config.Target{Prefix: "test_percent"}, state)
+	if got := metricSet.GetOrCreateCounter(name).Get(); got != 1 {
+		t.Errorf("processBaseMetrics() out of range counter = %v, want 1", got)
+	}
+	if got := metricSet.GetOrCreateCounter("test_percent_memory_max_used_percent").Get(); got != 150 {
+		t.Errorf("processBaseMetrics() max used percent = %v, want 150", got)
+	}
+}
+
 func Benchmark_parseMemoryString(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		parseMemoryString("C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793")
@@ -71,3 +235,2236 @@ func Benchmark_parseMemoryStringRegex(b *testing.B) {
 		parseMemoryStringRegex("C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205")
 	}
 }
+
+// largeStateResponse returns the sipproxyd sample with its counters repeated
+// the given number of times, like the response of a process with many trunks
+func largeStateResponse(b *testing.B, repeat int) []byte {
+	data, err := samples.ReadFile("resources/samples/sipproxyd-r6.0.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		b.Fatal(err)
+	}
+	counters := response["counterInfos"].([]interface{})
+	var large []interface{}
+	for i := 0; i < repeat; i++ {
+		large = append(large, counters...)
+	}
+	response["counterInfos"] = large
+	if data, err = json.Marshal(response); err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+func Benchmark_decodeC5StateResponse(b *testing.B) {
+	data := largeStateResponse(b, 100)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := decodeC5StateResponse(bytes.NewReader(data), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_processC5StateCounter(b *testing.B) {
+	state, err := decodeC5StateResponse(bytes.NewReader(largeStateResponse(b, 100)), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clearMetrics("bench_sipproxyd")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		processC5StateCounter("bench_sipproxyd", "", state.CounterInfos)
+	}
+}
+
+// counterInfos encodes the given lines, strings, string arrays or counters
+// with details, as counterInfos of a state response
+func counterInfos(lines ...interface{}) []json.RawMessage {
+	infos := make([]json.RawMessage, len(lines))
+	for i, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			panic(err)
+		}
+		infos[i] = data
+	}
+	return infos
+}
+
+func Test_processC5StateCounterFamilyDurations(t *testing.T) {
+	config.AppConfig.Verbose = true
+	defer func() { config.AppConfig.Verbose = false }()
+	processC5StateCounter("test_family", "", counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           0      0      0      0      0      0",
+		[]interface{}{
+			" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      0      0      0      0",
+			"                                                      0      0      0      0      0      0",
+		},
+	))
+	names := map[string]bool{}
+	for _, name := range metricSet.ListMetricNames() {
+		names[name] = true
+	}
+	for name, want := range map[string]uint64{
+		`c5_usage_counters_singleline{target="test_family"}`: 1,
+		`c5_usage_counters_multiline{target="test_family"}`:  1,
+	} {
+		if got := metricSet.GetOrCreateCounter(name).Get(); got != want {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got, want)
+		}
+	}
+	for _, family := range []string{"event", "usage", "subusage"} {
+		name := `c5_parse_family_duration_seconds{target="test_family",family="` + family + `"}`
+		if !names[name] {
+			t.Errorf("processC5StateCounter() missing metric %s", name)
+		}
+	}
+}
+
+func Test_processC5StateCounterFieldCounts(t *testing.T) {
+	config.AppConfig.Verbose = true
+	defer func() { config.AppConfig.Verbose = false }()
+	lines := counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"  1 TRANSPORT_MESSAGE_OUT                             6502      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           0      0      0      0      0      0",
+		[]interface{}{
+			" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      0      0      0      0",
+			"                                                      0      0      0      0      0      0",
+		},
+	)
+	fieldCounts := func() map[string]uint64 {
+		counts := map[string]uint64{}
+		for _, name := range metricSet.ListMetricNames() {
+			if strings.HasPrefix(name, `c5_line_field_count{target="test_fields",`) {
+				counts[name] = metricSet.GetOrCreateCounter(name).Get()
+			}
+		}
+		return counts
+	}
+	processC5StateCounter("test_fields", "", lines)
+	want := map[string]uint64{
+		`c5_line_field_count{target="test_fields",count="5"}`: 2,
+		`c5_line_field_count{target="test_fields",count="8"}`: 2,
+		`c5_line_field_count{target="test_fields",count="6"}`: 1,
+	}
+	if got := fieldCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("processC5StateCounter() field counts = %v, want %v", got, want)
+	}
+	// A second scrape replaces the previous distribution
+	processC5StateCounter("test_fields", "", lines[:3])
+	want = map[string]uint64{`c5_line_field_count{target="test_fields",count="5"}`: 2}
+	if got := fieldCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("processC5StateCounter() field counts after rescrape = %v, want %v", got, want)
+	}
+}
+
+func Test_processC5StateCounterDetails(t *testing.T) {
+	defer func() { config.AppConfig.CounterDetails = false }()
+	lines := []interface{}{
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		map[string]interface{}{
+			"counter": " 45 CALL_CONTROL_ACTIVE_CALLS                          12     10     14     10     14     12",
+			"details": map[string]interface{}{"threshold": 500.0, "description": "Active calls"},
+		},
+		map[string]interface{}{
+			"counter": " 309 BT_ACTIVE_CALLS                                    3      0      5      0      5      2",
+		},
+	}
+	tests := []struct {
+		name      string
+		enabled   bool
+		current   uint64
+		threshold bool
+	}{
+		{"disabled", false, 0, false},
+		{"enabled", true, 12, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := "test_details_" + tt.name
+			defer clearMetrics(prefix)
+			config.AppConfig.CounterDetails = tt.enabled
+			processC5StateCounter(prefix, "", counterInfos(lines...))
+			if got := metricSet.GetOrCreateCounter(prefix + "_call_control_active_calls_current").Get(); got != tt.current {
+				t.Errorf("processC5StateCounter() current = %v, want %v", got, tt.current)
+			}
+			thresholds := 0
+			for _, name := range metricSet.ListMetricNames() {
+				if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "_threshold") {
+					thresholds++
+				}
+			}
+			if tt.threshold {
+				if thresholds != 1 {
+					t.Errorf("processC5StateCounter() exported %v thresholds, want 1", thresholds)
+				}
+				if got := metricSet.GetOrCreateFloatCounter(prefix + "_call_control_active_calls_threshold").Get(); got != 500 {
+					t.Errorf("processC5StateCounter() threshold = %v, want 500", got)
+				}
+			} else if thresholds != 0 {
+				t.Errorf("processC5StateCounter() exported %v thresholds, want 0", thresholds)
+			}
+		})
+	}
+}
+
+func Test_counterHeaderType(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"event header", "       Event counters                              absolute   curr   last", "event"},
+		{"usage header", "       Usage counters                              current    min    max   lMin   lMax   lAvg", "usage"},
+		{"title only", "Usage counters", "usage"},
+		{"both titles", "       Event counters   Usage counters", "event"},
+		{"counter line", "  0 TRANSPORT_MESSAGE_IN                              6502      0     72", ""},
+		{"counter containing title", " 12 Event counters                                    1      0      0", ""},
+		{"name containing title", "  3 FOO_Usage counters                                 1      0      0", ""},
+		{"title prefix", "       Event countersX", ""},
+		{"observers", "    OBSERVERS  (dialog,csta,reg):  36,0,0", ""},
+		{"tab separated", "\tEvent\tcounters\tabsolute\tcurr\tlast", "event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterHeaderType(tt.line); got != tt.want {
+				t.Errorf("counterHeaderType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_processC5StateCounterTabSeparated(t *testing.T) {
+	defer clearMetrics("test_tabs")
+	processC5StateCounter("test_tabs", "", counterInfos(
+		"\tEvent counters\tabsolute\tcurr\tlast",
+		"  0\tTRANSPORT_MESSAGE_IN\t6502\t0\t72",
+		[]interface{}{
+			"425\tCASS_ERR_CONN_TMO \t 1\t0\t0",
+			"\t\t2\t386\t518",
+		},
+		"\tUsage\tcounters\tcurrent\tmin\tmax\tlMin\tlMax\tlAvg",
+		" 45\tCALL_CONTROL_ACTIVE_CALLS\t12\t10\t14\t10\t14\t12",
+		[]interface{}{
+			" 84\tTRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE\t1\t0\t3\t0\t9\t0",
+			"\t \t2\t0\t3\t0\t4\t0",
+		},
+	))
+	want := map[string]uint64{
+		"test_tabs_transport_message_in_total":                                6502,
+		`test_tabs_cass_err_conn_tmo_total{idx="1"}`:                          2,
+		"test_tabs_call_control_active_calls_current":                         12,
+		"test_tabs_call_control_active_calls_lastavg":                         12,
+		`test_tabs_transaction_and_tu_tu_manager_queue_size_lastmax{idx="1"}`: 4,
+	}
+	for name, value := range want {
+		if got := metricSet.GetOrCreateCounter(name).Get(); got != value {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got, value)
+		}
+	}
+}
+
+func Test_normalizeCounterLine(t *testing.T) {
+	tests := []struct {
+		line           string
+		want           string
+		wantNormalized bool
+	}{
+		{"  0 TRANSPORT_MESSAGE_IN     6502      0     72", "  0 TRANSPORT_MESSAGE_IN     6502      0     72", false},
+		{`"  0 TRANSPORT_MESSAGE_IN     6502      0     72"`, "  0 TRANSPORT_MESSAGE_IN     6502      0     72", true},
+		{`  0\tTRANSPORT_MESSAGE_IN\t6502\t0\t72`, "  0\tTRANSPORT_MESSAGE_IN\t6502\t0\t72", true},
+		{`\"  0 TRANSPORT_MESSAGE_IN     6502      0     72\"`, `"  0 TRANSPORT_MESSAGE_IN     6502      0     72"`, true},
+		{`"`, `"`, false},
+	}
+	for _, tt := range tests {
+		got, normalized := normalizeCounterLine(tt.line)
+		if got != tt.want || normalized != tt.wantNormalized {
+			t.Errorf("normalizeCounterLine(%q) = %q, %v, want %q, %v", tt.line, got, normalized, tt.want, tt.wantNormalized)
+		}
+	}
+}
+
+func Test_processC5StateCounterQuoted(t *testing.T) {
+	defer clearMetrics("test_quoted")
+	metricSet.UnregisterMetric(`c5_counter_lines_normalized_total{target="test_quoted"}`)
+	processC5StateCounter("test_quoted", "", counterInfos(
+		`"       Event counters                              absolute   curr   last"`,
+		`"  0 TRANSPORT_MESSAGE_IN                              6502      0     72"`,
+		[]interface{}{
+			`"425 CASS_ERR_CONN_TMO                                    1      0      0"`,
+			`"                                                        2    386    518"`,
+		},
+		`       Usage counters\t\t\t\tcurrent    min    max   lMin   lMax   lAvg`,
+		` 45 CALL_CONTROL_ACTIVE_CALLS\t12\t10\t14\t10\t14\t12`,
+	))
+	want := map[string]uint64{
+		"test_quoted_transport_message_in_total":                  6502,
+		`test_quoted_cass_err_conn_tmo_total{idx="1"}`:            2,
+		"test_quoted_call_control_active_calls_lastavg":           12,
+		`c5_counter_lines_normalized_total{target="test_quoted"}`: 6,
+		`c5_counter_parse_success{target="test_quoted"}`:          1,
+	}
+	for name, value := range want {
+		if got := metricSet.GetOrCreateCounter(name).Get(); got != value {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got, value)
+		}
+	}
+}
+
+func Test_processC5StateCounterHeaderToggles(t *testing.T) {
+	defer clearMetrics("test_toggle")
+	processC5StateCounter("test_toggle", "", counterInfos(
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           4      0      5      0      0      0",
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 46 CALL_CONTROL_ACTIVE_DIALOGS                         7      0      9      0      0      0",
+	))
+	for name, want := range map[string]uint64{
+		`c5_usage_counters_singleline{target="test_toggle"}`: 2,
+		`c5_usage_counters_multiline{target="test_toggle"}`:  0,
+		"test_toggle_call_control_active_calls_current":      4,
+		"test_toggle_transport_message_in_total":             6502,
+		"test_toggle_call_control_active_dialogs_current":    7,
+	} {
+		if got := metricSet.GetOrCreateCounter(name).Get(); got != want {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+const testStateResponse = `{
+  "proxyState" : "active",
+  "buildVersion" : "Version: 6.2.1.12, compiled on Jan 15 2021, 13:06:31 built by TELES Communication Systems GmbH",
+  "startupTime" : "2021-01-19 04:01:04.503",
+  "memoryUsage" : "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205",
+  "tuQueueStatus" : "OK - checked: 1830",
+  "counterInfos" : [
+    "       Event counters                              absolute   curr   last",
+    "  0 TRANSPORT_MESSAGE_IN                              6502      0     72"
+  ]
+}`
+
+func Test_fetchC5StateMetricsMethodAndBody(t *testing.T) {
+	var gotMethod, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		target     config.Target
+		wantMethod string
+		wantBody   string
+	}{
+		{"default", config.Target{Prefix: "test_get", URL: srv.URL}, "GET", ""},
+		{"post", config.Target{Prefix: "test_post", URL: srv.URL, Method: "POST", Body: "49&1&-v"}, "POST", "49&1&-v"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), tt.target, &wg)
+			if gotMethod != tt.wantMethod {
+				t.Errorf("fetchC5StateMetrics() method = %v, want %v", gotMethod, tt.wantMethod)
+			}
+			if gotBody != tt.wantBody {
+				t.Errorf("fetchC5StateMetrics() body = %v, want %v", gotBody, tt.wantBody)
+			}
+			if got := metricSet.GetOrCreateCounter(tt.target.Prefix + "_transport_message_in_total").Get(); got != 6502 {
+				t.Errorf("fetchC5StateMetrics() transport_message_in_total = %v, want 6502", got)
+			}
+		})
+	}
+}
+
+func Test_parseUint64Formats(t *testing.T) {
+	invalid := metricSet.GetOrCreateCounter(`c5_invalid_values_total`)
+	tests := []struct {
+		str     string
+		want    uint64
+		invalid uint64
+	}{
+		{"31", 31, 0},
+		{"0x1F", 31, 0},
+		{"0X1f", 31, 0},
+		{"010", 10, 0},
+		{"95%", 95, 0},
+		{"20ms", 20, 0},
+		{"0x1Fms", 31, 0},
+		{"0xFFFFFFFFFFFFFFFFF", math.MaxUint64, 0},
+		{"0x", 0, 1},
+		{"ms", 0, 1},
+		{"12kg", 0, 1},
+	}
+	for _, tt := range tests {
+		before := invalid.Get()
+		if got := parseUint64(tt.str); got != tt.want {
+			t.Errorf("parseUint64(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+		if got := invalid.Get() - before; got != tt.invalid {
+			t.Errorf("parseUint64(%q) invalid values = %v, want %v", tt.str, got, tt.invalid)
+		}
+	}
+}
+
+func Test_parseUint64Overflow(t *testing.T) {
+	overflow := metricSet.GetOrCreateCounter(`c5_counter_overflow_total`)
+	tests := []struct {
+		str      string
+		want     uint64
+		overflow uint64
+	}{
+		{"9223372036854775807", math.MaxInt64, 0},
+		{"9223372036854775808", math.MaxInt64 + 1, 0},
+		{"18446744073709551615", math.MaxUint64, 0},
+		{"18446744073709551616", math.MaxUint64, 1},
+		{"-9223372036854775809", 0, 0},
+		{"+42", 42, 0},
+	}
+	for _, tt := range tests {
+		before := overflow.Get()
+		if got := parseUint64(tt.str); got != tt.want {
+			t.Errorf("parseUint64(%q) = %v, want %v", tt.str, got, tt.want)
+		}
+		if got := overflow.Get() - before; got != tt.overflow {
+			t.Errorf("parseUint64(%q) overflows = %v, want %v", tt.str, got, tt.overflow)
+		}
+	}
+	before := overflow.Get()
+	if got := parseDataSize("17179869184GB"); got != math.MaxUint64 {
+		t.Errorf("parseDataSize() = %v, want %v", got, uint64(math.MaxUint64))
+	}
+	if got := overflow.Get() - before; got != 1 {
+		t.Errorf("parseDataSize() overflows = %v, want 1", got)
+	}
+}
+
+func Test_eventCounterDeltaNearMax(t *testing.T) {
+	tests := []struct {
+		total uint64
+		want  uint64
+	}{
+		{math.MaxInt64 - 10, 0},
+		{math.MaxInt64 + 5, 15},
+		{math.MaxUint64, math.MaxUint64 - math.MaxInt64 - 5},
+		{7, 7}, // reset
+	}
+	for i, tt := range tests {
+		got, ok := eventCounterDelta("test_delta_max", "test_delta_max_total", tt.total)
+		if i > 0 && (!ok || got != tt.want) {
+			t.Errorf("eventCounterDelta(%v) = %v, %v, want %v", tt.total, got, ok, tt.want)
+		}
+	}
+}
+
+func Test_parseUsageCounterNegative(t *testing.T) {
+	negative := metricSet.GetOrCreateCounter(`c5_negative_values_total`)
+	before := negative.Get()
+	c := parseUsageCounter(" 45 CALL_CONTROL_ACTIVE_CALLS                          -1      0      0      0      3      2")
+	if c.Current != 0 {
+		t.Errorf("parseUsageCounter() Current = %v, want 0", c.Current)
+	}
+	if c.LastMax != 3 || c.LastAvg != 2 {
+		t.Errorf("parseUsageCounter() LastMax, LastAvg = %v, %v, want 3, 2", c.LastMax, c.LastAvg)
+	}
+	if got := negative.Get() - before; got != 1 {
+		t.Errorf("parseUsageCounter() negative values = %v, want 1", got)
+	}
+}
+
+func Test_parseUsageCounterDataSize(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want usageCounter
+	}{
+		{"plain", " 45 CALL_CONTROL_ACTIVE_CALLS                           3      0      0      0      5      2",
+			usageCounter{ID: "45", Name: "CALL_CONTROL_ACTIVE_CALLS", Current: 3, LastMax: 5, LastAvg: 2}},
+		{"units", " 46 TRANSPORT_BUFFER_USAGE                           57MB      0      0      0    2GB   512kb",
+			usageCounter{ID: "46", Name: "TRANSPORT_BUFFER_USAGE", Current: 57 * mega, LastMax: 2048 * mega, LastAvg: 512 * 1024, Bytes: true}},
+		{"bytes", " 46 TRANSPORT_BUFFER_USAGE                           100B      0      0      0      0      0",
+			usageCounter{ID: "46", Name: "TRANSPORT_BUFFER_USAGE", Current: 100, Bytes: true}},
+		{"unknown unit", " 46 TRANSPORT_BUFFER_USAGE                          57MiB      0      0      0      0      0",
+			usageCounter{ID: "46", Name: "TRANSPORT_BUFFER_USAGE", Invalid: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUsageCounter(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUsageCounter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsConcurrent(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+
+	target := config.Target{Prefix: "test_concurrent", URL: srv.URL}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		go fetchC5StateMetrics(context.Background(), target, &wg)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("fetchC5StateMetrics() concurrent requests = %v, want 1", got)
+	}
+}
+
+func Test_targetNode(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url        string
+		hostHeader string
+		want       string
+	}{
+		{"http://10.0.0.2:9980/c5/proxy/commands?49&1&-v", "", "10.0.0.2"},
+		{"http://c5-node2.example.com:9980/c5/proxy/commands?49&1&-v", "", "c5-node2.example.com"},
+		{"http://localhost:9980/c5/proxy/commands?49&1&-v", "", hostname},
+		{"http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "", hostname},
+		{"http://[::1]:9980/c5/proxy/commands?49&1&-v", "", hostname},
+		{"http://127.0.0.1:19980/c5/proxy/commands?49&1&-v", "c5-node3.example.com:9980", "c5-node3.example.com"},
+		{"http://127.0.0.1:19980/c5/proxy/commands?49&1&-v", "c5-node3.example.com", "c5-node3.example.com"},
+		{"http://127.0.0.1:19980/c5/proxy/commands?49&1&-v", "[fd00::3]:9980", "fd00::3"},
+		{"http://10.0.0.2:9980/c5/proxy/commands?49&1&-v", "localhost", hostname},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := targetNode(config.Target{URL: tt.url, HostHeader: tt.hostHeader}); got != tt.want {
+			t.Errorf("targetNode(%q, %q) = %q, want %q", tt.url, tt.hostHeader, got, tt.want)
+		}
+	}
+
+	defer clearMetrics("test_node")
+	state, err := decodeC5StateResponse(strings.NewReader(testStateResponse), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processBaseMetrics(config.Target{Prefix: "test_node", URL: "http://10.0.0.2:9980/c5/proxy/commands"}, state)
+	info := `test_node_info{version="6.2.1.12",starttime="2021-01-19 04:01:04.503",node="10.0.0.2"}`
+	found := false
+	for _, name := range metricSet.ListMetricNames() {
+		found = found || name == info
+	}
+	if !found {
+		t.Errorf("processBaseMetrics() did not export %s", info)
+	}
+}
+
+func Test_parseBuildString(t *testing.T) {
+	tests := []struct {
+		name        string
+		build       string
+		wantVersion string
+		wantOk      bool
+		wantFormat  string
+	}{
+		{"prefixed", "Version: 6.0.2.57, compiled on Jan 15 2020, 13:06:31 built by TELES Communication Systems GmbH", "6.0.2.57", true, "prefixed"},
+		{"bare", "6.2.1.12, compiled on Jan 15 2021, 13:06:31 built by TELES Communication Systems GmbH", "6.2.1.12", true, "bare"},
+		{"bare only", "6.2.1.12", "6.2.1.12", true, "bare"},
+		{"empty", "", "", false, "invalid"},
+		{"invalid", "Build: unknown, compiled on Jan 15 2021", "", false, "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotVersion, gotOk := parseBuildString(tt.build)
+			if gotVersion != tt.wantVersion || gotOk != tt.wantOk {
+				t.Errorf("parseBuildString() = %v, %v, want %v, %v", gotVersion, gotOk, tt.wantVersion, tt.wantOk)
+			}
+			if got := buildStringFormat(tt.build, gotOk); got != tt.wantFormat {
+				t.Errorf("buildStringFormat() = %v, want %v", got, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsBaseOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_baseonly", URL: srv.URL, BaseOnly: true}, &wg)
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_baseonly_transport") {
+			t.Errorf("fetchC5StateMetrics() exported counter %s in base only mode", name)
+		}
+	}
+	if got := metricSet.GetOrCreateCounter(`c5_counterinfos_elements{target="test_baseonly"}`).Get(); got != 2 {
+		t.Errorf("fetchC5StateMetrics() c5_counterinfos_elements = %v, want 2", got)
+	}
+	if got := metricSet.GetOrCreateCounter("test_baseonly_state").Get(); got != 1 {
+		t.Errorf("fetchC5StateMetrics() state = %v, want 1", got)
+	}
+}
+
+func Test_fetchC5StateMetricsUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   uint64
+	}{
+		{"active", http.StatusOK, testStateResponse, 1},
+		{"passive", http.StatusOK, strings.Replace(testStateResponse, `"active"`, `"passive"`, 1), 0},
+		{"failed", http.StatusInternalServerError, testStateResponse, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			// Start from the opposite value to detect missing updates
+			metricSet.GetOrCreateCounter(`c5_test_up_up`).Set(1 - tt.want)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_up", URL: srv.URL, BaseOnly: true}, &wg)
+			if got := metricSet.GetOrCreateCounter(`c5_test_up_up`).Get(); got != tt.want {
+				t.Errorf("fetchC5StateMetrics() c5_test_up_up = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsBundle(t *testing.T) {
+	acdqueued := strings.Replace(strings.Replace(testStateResponse, `"proxyState"`, `"queueState"`, 1), "TRANSPORT_MESSAGE_IN", "ACD_CALLS_QUEUED", 1)
+	tests := []struct {
+		name    string
+		body    string
+		success uint64
+		want    map[string]uint64
+	}{
+		{"bundle", `{"sipproxyd": ` + testStateResponse + `, "acdqueued": ` + acdqueued + `}`, 1, map[string]uint64{
+			"test_bundle_sipproxyd_state":                      1,
+			"test_bundle_sipproxyd_transport_message_in_total": 6502,
+			"test_bundle_acdqueued_state":                      1,
+			"test_bundle_acdqueued_acd_calls_queued_total":     6502,
+		}},
+		{"invalid process name", `{"sip-proxyd": ` + testStateResponse + `}`, 0, nil},
+		{"invalid response", `{"sipproxyd": []}`, 0, nil},
+		{"single response", testStateResponse, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			defer clearMetrics("test_bundle")
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_bundle", URL: srv.URL, Bundle: true}, &wg)
+			if got := metricSet.GetOrCreateCounter(`c5_scrape_success{target="test_bundle"}`).Get(); got != tt.success {
+				t.Errorf("fetchC5StateMetrics() c5_scrape_success = %v, want %v", got, tt.success)
+			}
+			for name, want := range tt.want {
+				if got := metricSet.GetOrCreateCounter(name).Get(); got != want {
+					t.Errorf("fetchC5StateMetrics() %s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsBundleVanished(t *testing.T) {
+	acdqueued := strings.Replace(testStateResponse, `"proxyState"`, `"queueState"`, 1)
+	body := `{"sipproxyd": ` + testStateResponse + `, "acdqueued": ` + acdqueued + `}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	defer clearMetrics("test_gone")
+	target := config.Target{Prefix: "test_gone", URL: srv.URL, Bundle: true}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, &wg)
+	if got := metricSet.GetOrCreateCounter("test_gone_acdqueued_state").Get(); got != 1 {
+		t.Fatalf("fetchC5StateMetrics() test_gone_acdqueued_state = %v, want 1", got)
+	}
+
+	body = `{"sipproxyd": ` + testStateResponse + `}`
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, &wg)
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.Contains(name, "test_gone_acdqueued") {
+			t.Errorf("fetchC5StateMetrics() kept %s of vanished process", name)
+		}
+	}
+	if got := metricSet.GetOrCreateCounter("test_gone_sipproxyd_state").Get(); got != 1 {
+		t.Errorf("fetchC5StateMetrics() test_gone_sipproxyd_state = %v, want 1", got)
+	}
+}
+
+func Test_fetchC5StateMetricsProfileAllocations(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer clearMetrics("test_allocs")
+	tests := []struct {
+		name    string
+		profile bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+	defer func() { config.AppConfig.ProfileAllocations = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.ProfileAllocations = tt.profile
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_allocs", URL: srv.URL}, &wg)
+			names := map[string]bool{}
+			for _, name := range metricSet.ListMetricNames() {
+				names[name] = true
+			}
+			for _, phase := range []string{"decode", "counters"} {
+				name := `c5_parse_alloc_bytes{target="test_allocs",phase="` + phase + `"}`
+				if names[name] != tt.profile {
+					t.Errorf("fetchC5StateMetrics() exported %s = %v, want %v", name, names[name], tt.profile)
+				} else if tt.profile && metricSet.GetOrCreateCounter(name).Get() == 0 {
+					t.Errorf("fetchC5StateMetrics() %s = 0, want allocated bytes", name)
+				}
+			}
+		})
+	}
+	for _, phase := range []string{"decode", "counters"} {
+		metricSet.UnregisterMetric(`c5_parse_alloc_bytes{target="test_allocs",phase="` + phase + `"}`)
+	}
+}
+
+func Test_fetchC5StateMetricsStrictBuildVersion(t *testing.T) {
+	malformed := strings.Replace(testStateResponse, "Version: 6.2.1.12", "Version: unknown", 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(malformed))
+	}))
+	defer srv.Close()
+	defer func() { config.AppConfig.StrictBuildVersion = false }()
+
+	tests := []struct {
+		name    string
+		prefix  string
+		strict  bool
+		success uint64
+		info    bool
+	}{
+		{"lenient", "test_build_lenient", false, 1, true},
+		{"strict", "test_build_strict", true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.StrictBuildVersion = tt.strict
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: tt.prefix, URL: srv.URL}, &wg)
+			if got := metricSet.GetOrCreateCounter(`c5_scrape_success{target="` + tt.prefix + `"}`).Get(); got != tt.success {
+				t.Errorf("fetchC5StateMetrics() c5_scrape_success = %v, want %v", got, tt.success)
+			}
+			info := false
+			for _, name := range metricSet.ListMetricNames() {
+				if strings.HasPrefix(name, tt.prefix+"_info{") {
+					info = true
+				}
+			}
+			if info != tt.info {
+				t.Errorf("fetchC5StateMetrics() exported info = %v, want %v", info, tt.info)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsScrapeErrors(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	tests := []struct {
+		name   string
+		url    string
+		reason string
+	}{
+		{"unresolvable host", "http://c5-exporter-test.invalid:9980/c5/proxy/commands?49&1&-v", "dns"},
+		{"connection refused", closed.URL, "connect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_errors", URL: tt.url}, &wg)
+			name := `c5_scrape_errors_total{target="test_errors",reason="` + tt.reason + `"}`
+			if got := metricSet.GetOrCreateCounter(name).Get(); got != 1 {
+				t.Errorf("fetchC5StateMetrics() %s = %v, want 1", name, got)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsScrapeDuration(t *testing.T) {
+	defer func(d config.Duration) { config.AppConfig.Timeout = d }(config.AppConfig.Timeout)
+	config.AppConfig.Timeout = config.Duration{Duration: 2 * time.Second}
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	tests := []struct {
+		target      config.Target
+		wantTimeout float64
+	}{
+		{config.Target{Prefix: "test_duration", URL: c5.URL}, 2},
+		{config.Target{Prefix: "test_duration_override", URL: c5.URL, Timeout: config.Duration{Duration: 5 * time.Second}}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target.Prefix, func(t *testing.T) {
+			defer clearMetrics(tt.target.Prefix)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), tt.target, &wg)
+			duration := metricSet.GetOrCreateFloatCounter(`c5_scrape_duration_seconds{target="` + tt.target.Prefix + `"}`).Get()
+			if duration < 0.02 || duration > tt.wantTimeout {
+				t.Errorf("fetchC5StateMetrics() c5_scrape_duration_seconds = %v, want between 0.02 and %v", duration, tt.wantTimeout)
+			}
+			if got := metricSet.GetOrCreateFloatCounter(`c5_scrape_timeout_seconds{target="` + tt.target.Prefix + `"}`).Get(); got != tt.wantTimeout {
+				t.Errorf("fetchC5StateMetrics() c5_scrape_timeout_seconds = %v, want %v", got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsTimeouts(t *testing.T) {
+	defer func(c, r config.Duration) {
+		config.AppConfig.ConnectTimeout, config.AppConfig.RequestTimeout = c, r
+	}(config.AppConfig.ConnectTimeout, config.AppConfig.RequestTimeout)
+	config.AppConfig.ConnectTimeout = config.Duration{Duration: 50 * time.Millisecond}
+	config.AppConfig.RequestTimeout = config.Duration{Duration: 200 * time.Millisecond}
+	stall := func(r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+	// Proxy accepting connections, but only answering CONNECT requests late
+	slowAccept := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stall(r)
+	}))
+	defer slowAccept.Close()
+	slowHeaders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stall(r)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer slowHeaders.Close()
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStateResponse[:len(testStateResponse)/2]))
+		w.(http.Flusher).Flush()
+		stall(r)
+	}))
+	defer slowBody.Close()
+
+	tests := []struct {
+		name   string
+		target config.Target
+		reason string
+	}{
+		{"slow accept", config.Target{Prefix: "test_timeout_accept", URL: slowHeaders.URL, Proxy: slowAccept.URL}, "connect_timeout"},
+		{"slow headers", config.Target{Prefix: "test_timeout_headers", URL: slowHeaders.URL}, "timeout"},
+		{"slow body", config.Target{Prefix: "test_timeout_body", URL: slowBody.URL}, "timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			start := time.Now()
+			fetchC5StateMetrics(context.Background(), tt.target, &wg)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("fetchC5StateMetrics() took %v, want timeout after 200ms", elapsed)
+			}
+			name := `c5_scrape_errors_total{target="` + tt.target.Prefix + `",reason="` + tt.reason + `"}`
+			if got := metricSet.GetOrCreateCounter(name).Get(); got != 1 {
+				t.Errorf("fetchC5StateMetrics() %s = %v, want 1", name, got)
+			}
+		})
+	}
+}
+
+func Test_setQueueDepthTrend(t *testing.T) {
+	name := `c5_acdqueued_queue_depth_trend{target="acdqueued",counter="acd_queue_depth"}`
+	defer func() {
+		metricSet.UnregisterMetric(name)
+		delete(queueDepthTrends, name)
+	}()
+	tests := []struct {
+		current uint64
+		want    float64
+	}{
+		{10, 10},
+		{20, 13},
+		{20, 15.1},
+	}
+	for _, tt := range tests {
+		setQueueDepthTrend("acdqueued", "acdqueued", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: tt.current})
+		if got := metricSet.GetOrCreateFloatCounter(name).Get(); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("setQueueDepthTrend(%v) = %v, want %v", tt.current, got, tt.want)
+		}
+	}
+	// Other processes and counters are ignored
+	setQueueDepthTrend("sipproxyd", "sipproxyd", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 1})
+	setQueueDepthTrend("node2_sipproxyd", "", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 1})
+	setQueueDepthTrend("acdqueued", "acdqueued", usageCounter{Name: "CALL_CONTROL_ACTIVE_CALLS", Current: 1})
+	for _, m := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(m, "c5_acdqueued_queue_depth_trend") && m != name {
+			t.Errorf("setQueueDepthTrend() unexpected metric %s", m)
+		}
+	}
+}
+
+func Test_setQueueDepthTrendTargets(t *testing.T) {
+	node2 := `c5_acdqueued_queue_depth_trend{target="node2_acdqueued",counter="acd_queue_depth"}`
+	node3 := `c5_acdqueued_queue_depth_trend{target="node3_acdqueued",counter="acd_queue_depth"}`
+	defer clearMetrics("node3_acdqueued")
+	setQueueDepthTrend("node2_acdqueued", "acdqueued", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 10})
+	setQueueDepthTrend("node3_acdqueued", "acdqueued", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 20})
+	if got := metricSet.GetOrCreateFloatCounter(node3).Get(); got != 20 {
+		t.Errorf("setQueueDepthTrend() %s = %v, want 20", node3, got)
+	}
+	clearMetrics("node2_acdqueued")
+	queueDepthMu.Lock()
+	_, kept := queueDepthTrends[node2]
+	_, other := queueDepthTrends[node3]
+	queueDepthMu.Unlock()
+	if kept || !other {
+		t.Errorf("clearMetrics() kept trend of node2 = %v, of node3 = %v, want false and true", kept, other)
+	}
+	for _, m := range metricSet.ListMetricNames() {
+		if m == node2 {
+			t.Errorf("clearMetrics() kept %s", m)
+		}
+	}
+}
+
+func Test_setQueueDepthTrendRounding(t *testing.T) {
+	name := `c5_acdqueued_queue_depth_trend{target="acdqueued",counter="acd_queue_depth"}`
+	defer func() {
+		config.AppConfig.AverageRounding = ""
+		metricSet.UnregisterMetric(name)
+		delete(queueDepthTrends, name)
+	}()
+	tests := []struct {
+		rounding string
+		want     float64
+	}{
+		{"none", 13},
+		{"round", 15},
+		{"floor", 16},
+		{"ceil", 18},
+	}
+	// Trend of 10, 20, 20, 20, 20 is 13, 15.1, 16.57 and 17.599 unrounded
+	setQueueDepthTrend("acdqueued", "acdqueued", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 10})
+	for _, tt := range tests {
+		config.AppConfig.AverageRounding = tt.rounding
+		setQueueDepthTrend("acdqueued", "acdqueued", usageCounter{Name: "ACD_QUEUE_DEPTH", Current: 20})
+		if got := metricSet.GetOrCreateFloatCounter(name).Get(); got < tt.want-1e-9 || got > tt.want+1e-9 {
+			t.Errorf("setQueueDepthTrend() with %s rounding = %v, want %v", tt.rounding, got, tt.want)
+		}
+	}
+	if got := queueDepthTrends[name]; got < 17.599-1e-9 || got > 17.599+1e-9 {
+		t.Errorf("setQueueDepthTrend() kept trend %v, want unrounded 17.599", got)
+	}
+}
+
+func Test_fetchC5StateMetricsHTTPStatus(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer clearMetrics("test_status")
+	name := `c5_last_http_status{target="test_status"}`
+	tests := []struct {
+		name   string
+		status int
+		want   uint64
+		state  bool
+	}{
+		{"ok", http.StatusOK, 200, true},
+		{"unauthorized", http.StatusUnauthorized, 401, false},
+		{"unavailable", http.StatusServiceUnavailable, 503, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_status", URL: srv.URL}, &wg)
+			if got := metricSet.GetOrCreateCounter(name).Get(); got != tt.want {
+				t.Errorf("fetchC5StateMetrics() %s = %v, want %v", name, got, tt.want)
+			}
+			state := false
+			for _, m := range metricSet.ListMetricNames() {
+				state = state || m == "test_status_state"
+			}
+			if state != tt.state {
+				t.Errorf("fetchC5StateMetrics() state metric exported = %v, want %v", state, tt.state)
+			}
+		})
+	}
+	srv.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_status", URL: srv.URL}, &wg)
+	if got := metricSet.GetOrCreateCounter(name).Get(); got != 0 {
+		t.Errorf("fetchC5StateMetrics() %s without response = %v, want 0", name, got)
+	}
+}
+
+func Test_fetchC5StateMetricsContentType(t *testing.T) {
+	contentType := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer clearScrapeStatus("test_ctype")
+	defer clearMetrics("test_ctype")
+	prefix := `c5_test_ctype_response_content_type_info{`
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"application/json", prefix + `content_type="application/json"}`},
+		{"text/html; charset=utf-8", prefix + `content_type="text/html"}`},
+		{"", prefix + `content_type="none"}`},
+	}
+	for _, tt := range tests {
+		contentType = tt.header
+		var wg sync.WaitGroup
+		wg.Add(1)
+		fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_ctype", URL: srv.URL}, &wg)
+		var got []string
+		for _, name := range metricSet.ListMetricNames() {
+			if strings.HasPrefix(name, prefix) {
+				got = append(got, name)
+			}
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("fetchC5StateMetrics() content type for %q = %v, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func Test_processC5StateCounterCstagwSublines(t *testing.T) {
+	defer clearMetrics("test_csta")
+	lines := counterInfos(
+		"       Event counters                              absolute   curr   last",
+		[]interface{}{"425 CASS_ERR_CONN_TMO                                  0      0      0"},
+	)
+	tests := []struct {
+		prefix string
+		daemon string
+		want   bool
+	}{
+		{"test_csta_node2", "cstagwd", false},
+		{"test_csta_proxy", "sipproxyd", true},
+	}
+	for _, tt := range tests {
+		processC5StateCounter(tt.prefix, tt.daemon, lines)
+		found := false
+		for _, name := range metricSet.ListMetricNames() {
+			found = found || strings.HasPrefix(name, tt.prefix+"_cass_err_conn_tmo_total")
+		}
+		if found != tt.want {
+			t.Errorf("processC5StateCounter(%s) single event subline exported = %v, want %v", tt.daemon, found, tt.want)
+		}
+	}
+}
+
+func Test_processC5StateCounterMaxSubUsageLines(t *testing.T) {
+	defer func() { config.AppConfig.MaxSubUsageLines = 0 }()
+	config.AppConfig.MaxSubUsageLines = 3
+	defer clearMetrics("test_capped")
+	block := []interface{}{" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      3      0      9      0"}
+	for i := 0; i < 5; i++ {
+		block = append(block, "                                                      0      0      3      0      4      0")
+	}
+	processC5StateCounter("test_capped", "", counterInfos(
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		block,
+	))
+	series := 0
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_capped_transaction_and_tu_tu_manager_queue_size_current") {
+			series++
+		}
+	}
+	if series != 4 {
+		t.Errorf("processC5StateCounter() exported %d series, want 4", series)
+	}
+	if got := metricSet.GetOrCreateCounter(`c5_sub_usage_lines_capped_total{target="test_capped"}`).Get(); got != 2 {
+		t.Errorf("processC5StateCounter() capped lines = %v, want 2", got)
+	}
+}
+
+func Test_processC5StateCounterSumSubUsage(t *testing.T) {
+	defer func() { config.AppConfig.SumSubUsageCounters = false }()
+	lines := counterInfos(
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		[]interface{}{
+			" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          1      0      3      0      9      0",
+			"                                                      2      0      3      0      4      0",
+			"                                                      4      0      3      0      4      0",
+		},
+	)
+	sum := "test_sum_transaction_and_tu_tu_manager_queue_size_current"
+	for _, enabled := range []bool{false, true} {
+		config.AppConfig.SumSubUsageCounters = enabled
+		clearMetrics("test_sum")
+		processC5StateCounter("test_sum", "", lines)
+		registered := false
+		for _, name := range metricSet.ListMetricNames() {
+			registered = registered || name == sum
+		}
+		if registered != enabled {
+			t.Errorf("processC5StateCounter() with sumSubUsageCounters = %v exported %s: %v", enabled, sum, registered)
+		}
+	}
+	defer clearMetrics("test_sum")
+	if got := metricSet.GetOrCreateCounter(sum).Get(); got != 7 {
+		t.Errorf("processC5StateCounter() %s = %v, want 7", sum, got)
+	}
+	if got := metricSet.GetOrCreateCounter(`test_sum_transaction_and_tu_tu_manager_queue_size_current{idx="2"}`).Get(); got != 4 {
+		t.Errorf("processC5StateCounter() idx 2 = %v, want 4", got)
+	}
+}
+
+func Test_processC5StateCounterDataSize(t *testing.T) {
+	defer clearMetrics("test_size")
+	processC5StateCounter("test_size", "", counterInfos(
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           3      0      0      0      0      0",
+		" 46 TRANSPORT_BUFFER_USAGE                           57MB      0      0      0   64MB   32MB",
+	))
+	want := map[string]uint64{
+		"test_size_call_control_active_calls_current":    3,
+		"test_size_transport_buffer_usage_current_bytes": 57 * mega,
+		"test_size_transport_buffer_usage_lastmin_bytes": 0,
+		"test_size_transport_buffer_usage_lastmax_bytes": 64 * mega,
+		"test_size_transport_buffer_usage_lastavg_bytes": 32 * mega,
+	}
+	got := map[string]uint64{}
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_size_") {
+			got[name] = metricSet.GetOrCreateCounter(name).Get()
+		}
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got[name], v)
+		}
+	}
+	if _, ok := got["test_size_transport_buffer_usage_current"]; ok {
+		t.Error("processC5StateCounter() exported test_size_transport_buffer_usage_current without unit")
+	}
+}
+
+func Test_processC5StateCounterDataSizeSticky(t *testing.T) {
+	defer clearMetrics("test_sticky")
+	header := "       Usage counters                              current    min    max   lMin   lMax   lAvg"
+	processC5StateCounter("test_sticky", "", counterInfos(header,
+		" 46 TRANSPORT_BUFFER_USAGE                            512      0      0      0    512    512",
+	))
+	processC5StateCounter("test_sticky", "", counterInfos(header,
+		" 46 TRANSPORT_BUFFER_USAGE                           57MB      0      0      0   64MB   32MB",
+	))
+	processC5StateCounter("test_sticky", "", counterInfos(header,
+		" 46 TRANSPORT_BUFFER_USAGE                            100      0      0      0    100    100",
+		" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE",
+		[]string{
+			"    84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE       0      0      3      0      9      0",
+			"                                                    2KB      0      3      0      4      0",
+		},
+	))
+	want := map[string]uint64{
+		"test_sticky_transport_buffer_usage_current_bytes":                            100,
+		"test_sticky_transport_buffer_usage_lastmax_bytes":                            100,
+		`test_sticky_transaction_and_tu_tu_manager_queue_size_current_bytes{idx="0"}`: 0,
+		`test_sticky_transaction_and_tu_tu_manager_queue_size_current_bytes{idx="1"}`: 2048,
+	}
+	for _, name := range metricSet.ListMetricNames() {
+		if !strings.HasPrefix(name, "test_sticky_") {
+			continue
+		}
+		if !strings.Contains(name, "_bytes") {
+			t.Errorf("processC5StateCounter() exported %s without unit", name)
+		}
+	}
+	for name, v := range want {
+		if got := metricSet.GetOrCreateCounter(name).Get(); got != v {
+			t.Errorf("processC5StateCounter() %s = %v, want %v", name, got, v)
+		}
+	}
+}
+
+func Test_processC5StateCounterParseSuccess(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     []interface{}
+		want      uint64
+		wantRatio float64
+	}{
+		{"valid", []interface{}{
+			"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+			" 45 CALL_CONTROL_ACTIVE_CALLS                           0      0      0      0      0      0",
+		}, 1, 1},
+		{"malformed usage line", []interface{}{
+			"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+			" 45 CALL_CONTROL_ACTIVE_CALLS                           0      x",
+		}, 0, 0},
+		{"malformed continuation line", []interface{}{
+			"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+			[]interface{}{
+				" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      3      0      9      0",
+				"                                                      0      x",
+			},
+		}, 0, 0.5},
+		{"invalid values", []interface{}{
+			"       Event counters                              absolute   curr   last",
+			"  0 TRANSPORT_MESSAGE_IN                               n/a      0     72",
+			"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+			" 45 CALL_CONTROL_ACTIVE_CALLS                           0      0      0      0      x      0",
+		}, 1, 0.6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer clearMetrics("test_parse_success")
+			processC5StateCounter("test_parse_success", "", counterInfos(tt.lines...))
+			if got := metricSet.GetOrCreateCounter(`c5_counter_parse_success{target="test_parse_success"}`).Get(); got != tt.want {
+				t.Errorf("processC5StateCounter() c5_counter_parse_success = %v, want %v", got, tt.want)
+			}
+			if got := metricSet.GetOrCreateFloatCounter(`c5_parse_field_success_ratio{target="test_parse_success"}`).Get(); got != tt.wantRatio {
+				t.Errorf("processC5StateCounter() c5_parse_field_success_ratio = %v, want %v", got, tt.wantRatio)
+			}
+			for _, name := range metricSet.ListMetricNames() {
+				if strings.HasPrefix(name, "test_parse_success__") {
+					t.Errorf("processC5StateCounter() exported %s for malformed line", name)
+				}
+			}
+		})
+	}
+}
+
+func Test_parseSubCounterBlankLines(t *testing.T) {
+	usage, _ := parseSubUsageCounter([]string{
+		" 84 TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          1      0      3      0      9      0",
+		"                                                           ",
+		"",
+		"                                                      2      0      3      0      4      0",
+	})
+	if len(usage) != 2 {
+		t.Fatalf("parseSubUsageCounter() = %d counters, want 2", len(usage))
+	}
+	for i, c := range usage {
+		if c.Name != "TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE" || *c.Idx != i || c.Current != uint64(i+1) {
+			t.Errorf("parseSubUsageCounter()[%d] = %s idx %d current %d", i, c.Name, *c.Idx, c.Current)
+		}
+	}
+	events := parseSubEventCounter([]string{
+		"425 CASS_ERR_CONN_TMO                                  1      0      0",
+		"   ",
+		"                                                       2    386    518",
+	})
+	if len(events) != 2 {
+		t.Fatalf("parseSubEventCounter() = %d counters, want 2", len(events))
+	}
+	for i, c := range events {
+		if c.Name != "CASS_ERR_CONN_TMO" || *c.Idx != i || c.Total != uint64(i+1) {
+			t.Errorf("parseSubEventCounter()[%d] = %s idx %d total %d", i, c.Name, *c.Idx, c.Total)
+		}
+	}
+}
+
+func Test_scrapeAllTargetsCount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{
+		{Prefix: "test_count1", URL: srv.URL + "/1"},
+		{Prefix: "test_count2", URL: srv.URL + "/2"},
+	})
+	defer clearMetrics("test_count")
+	scrapeAll(context.Background())
+	if got := metricSet.GetOrCreateCounter(`c5_scrape_targets_count`).Get(); got != 2 {
+		t.Errorf("scrapeAll() c5_scrape_targets_count = %v, want 2", got)
+	}
+	if got := metricSet.GetOrCreateFloatCounter(`c5_handler_wait_seconds`).Get(); got <= 0 {
+		t.Errorf("scrapeAll() c5_handler_wait_seconds = %v, want > 0", got)
+	}
+}
+
+func Test_warmup(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hanging" {
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer close(hang)
+	defer func(timeout time.Duration) { config.AppConfig.Timeout.Duration = timeout }(config.AppConfig.Timeout.Duration)
+	config.AppConfig.Timeout.Duration = 100 * time.Millisecond
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{
+		{Prefix: "test_warmup_ok", URL: srv.URL},
+		{Prefix: "test_warmup_hanging", URL: srv.URL + "/hanging"},
+	})
+	defer clearMetrics("test_warmup")
+	start := time.Now()
+	warmup()
+	// The hanging target must not block the startup beyond the scrape deadline
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("warmup() took %v, want at most %v", elapsed, scrapeDeadline())
+	}
+	for prefix, want := range map[string]uint64{"test_warmup_ok": 1, "test_warmup_hanging": 0} {
+		if got := metricSet.GetOrCreateCounter(`c5_scrape_success{target="` + prefix + `"}`).Get(); got != want {
+			t.Errorf("warmup() c5_scrape_success of %s = %v, want %v", prefix, got, want)
+		}
+	}
+}
+
+func Test_logErrorLimit(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { config.AppConfig.ErrorLogLimit = 0 }()
+	config.AppConfig.ErrorLogLimit = 2
+	suppressed := metricSet.GetOrCreateCounter(`c5_log_errors_suppressed_total`)
+	suppressed.Set(0)
+	errorLogStart = time.Time{}
+	for i := 0; i < 5; i++ {
+		logError("Failed to parse as uint64:", "x")
+	}
+	logError("Failed to parse as uint64:", "y")
+	if got := strings.Count(buf.String(), "uint64: x"); got != 2 {
+		t.Errorf("logError() logged the repeated error %d times, want 2", got)
+	}
+	if got := strings.Count(buf.String(), "uint64: y"); got != 1 {
+		t.Errorf("logError() logged another error %d times, want 1", got)
+	}
+	if got := suppressed.Get(); got != 3 {
+		t.Errorf("c5_log_errors_suppressed_total = %v, want 3", got)
+	}
+	// The suppressed errors are summarized once the window is over
+	buf.Reset()
+	errorLogStart = errorLogStart.Add(-errorLogWindow)
+	logError("Failed to parse as uint64:", "x")
+	if !strings.Contains(buf.String(), "Suppressed 3 repeated error messages") || !strings.Contains(buf.String(), "uint64: x") {
+		t.Errorf("logError() after the window logged %q", buf.String())
+	}
+}
+
+func Test_newC5TransportHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	plainSrv := httptest.NewServer(handler)
+	defer plainSrv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsSrv.Certificate())
+
+	tests := []struct {
+		name    string
+		disable bool
+		url     string
+		want    string
+	}{
+		{"https disabled", true, tlsSrv.URL, "HTTP/1.1"},
+		{"https default", false, tlsSrv.URL, "HTTP/2.0"},
+		{"http default", false, plainSrv.URL, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newC5Transport(&config.AppConfiguration{DisableHTTP2: tt.disable})
+			tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+			client := http.Client{Transport: tr}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("protocol = %v, want %v", string(body), tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateCounterTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		types   map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"normalized", map[string]string{"transport_message_in": "Gauge"}, map[string]string{"TRANSPORT_MESSAGE_IN": "gauge"}, false},
+		{"unknown counter", map[string]string{"FOO": "counter"}, nil, true},
+		{"invalid type", map[string]string{"TRANSPORT_MESSAGE_IN": "histogram"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &config.AppConfiguration{CounterTypes: tt.types}
+			err := validateCounterTypes(conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateCounterTypes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(conf.CounterTypes, tt.want) {
+				t.Errorf("validateCounterTypes() = %v, want %v", conf.CounterTypes, tt.want)
+			}
+		})
+	}
+}
+
+func Test_processC5StateCounterTypeOverrides(t *testing.T) {
+	config.AppConfig.CounterTypes = map[string]string{
+		"TRANSPORT_MESSAGE_IN":      "gauge",
+		"CALL_CONTROL_ACTIVE_CALLS": "counter",
+	}
+	defer func() { config.AppConfig.CounterTypes = nil }()
+	defer clearMetrics("test_types")
+	processC5StateCounter("test_types", "", counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"  1 TRANSPORT_MESSAGE_OUT                             6503      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           4      0      0      0      0      0",
+		" 46 CALL_CONTROL_ACTIVE_DIALOGS                         5      0      0      0      0      0",
+	))
+	var got []string
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_types_") {
+			got = append(got, name)
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		"test_types_call_control_active_calls_total",
+		"test_types_call_control_active_dialogs_current",
+		"test_types_call_control_active_dialogs_lastavg",
+		"test_types_call_control_active_dialogs_lastmax",
+		"test_types_call_control_active_dialogs_lastmin",
+		"test_types_transport_message_in_current",
+		"test_types_transport_message_out_total",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processC5StateCounter() metrics = %v, want %v", got, want)
+	}
+}
+
+func Test_processC5StateCounterKeepOldCounterTypes(t *testing.T) {
+	config.AppConfig.CounterTypes = map[string]string{
+		"TRANSPORT_MESSAGE_IN":      "gauge",
+		"CALL_CONTROL_ACTIVE_CALLS": "counter",
+	}
+	config.AppConfig.KeepOldCounterTypes = true
+	defer func() {
+		config.AppConfig.CounterTypes = nil
+		config.AppConfig.KeepOldCounterTypes = false
+	}()
+	defer clearMetrics("test_keep_types")
+	processC5StateCounter("test_keep_types", "", counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           4      0      0      0      0      0",
+	))
+	var got []string
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_keep_types_") {
+			got = append(got, name)
+		}
+	}
+	sort.Strings(got)
+	want := []string{
+		"test_keep_types_call_control_active_calls_current",
+		"test_keep_types_call_control_active_calls_lastavg",
+		"test_keep_types_call_control_active_calls_lastmax",
+		"test_keep_types_call_control_active_calls_lastmin",
+		"test_keep_types_call_control_active_calls_total",
+		"test_keep_types_transport_message_in_current",
+		"test_keep_types_transport_message_in_total",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processC5StateCounter() metrics = %v, want %v", got, want)
+	}
+}
+
+func Test_newTargetRequestVerbosity(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   config.Target
+		wantURL  string
+		wantBody string
+	}{
+		{"unchanged", config.Target{URL: "http://c5:9980/c5/proxy/commands?49&1&-v"}, "http://c5:9980/c5/proxy/commands?49&1&-v", ""},
+		{"more verbose", config.Target{URL: "http://c5:9980/c5/proxy/commands?49&1&-v", Verbosity: "-vv"}, "http://c5:9980/c5/proxy/commands?49&1&-vv", ""},
+		{"none", config.Target{URL: "http://c5:9980/c5/proxy/commands?49&1&-v", Verbosity: "none"}, "http://c5:9980/c5/proxy/commands?49&1", ""},
+		{"appended", config.Target{URL: "http://c5:9980/c5/proxy/commands?49&1", Verbosity: "-v"}, "http://c5:9980/c5/proxy/commands?49&1&-v", ""},
+		{"body", config.Target{URL: "http://c5:9980/c5/proxy/commands", Method: "POST", Body: "49&1&-v", Verbosity: "-vvv"}, "http://c5:9980/c5/proxy/commands", "49&1&-vvv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newTargetRequest(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.URL.String(); got != tt.wantURL {
+				t.Errorf("newTargetRequest() url = %v, want %v", got, tt.wantURL)
+			}
+			var body []byte
+			if req.Body != nil {
+				body, _ = ioutil.ReadAll(req.Body)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("newTargetRequest() body = %v, want %v", string(body), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsHostHeader(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_host_header", URL: srv.URL, HostHeader: "c5-node2.example.com:9980"}, &wg)
+	if host != "c5-node2.example.com:9980" {
+		t.Errorf("fetchC5StateMetrics() sent Host %q, want c5-node2.example.com:9980", host)
+	}
+	clearMetrics("test_host_header")
+}
+
+func Test_decodeC5StateResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantState    string
+		wantCounters int
+		wantErr      bool
+	}{
+		{"document", testStateResponse, "active", 2, false},
+		{"ndjson", `{"proxyState": "active", "counterInfos": ["       Event counters       absolute   curr   last"]}
+{"startupTime": "2021-01-19 04:01:04.503"}
+{"counterInfos": ["  0 TRANSPORT_MESSAGE_IN     6502      0     72"]}
+`, "active", 2, false},
+		{"empty", "", "", 0, true},
+		{"truncated", `{"proxyState": "active"}
+{"counterInfos": [`, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeC5StateResponse(strings.NewReader(tt.body), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeC5StateResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.ProxyState != tt.wantState || len(got.CounterInfos) != tt.wantCounters {
+				t.Errorf("decodeC5StateResponse() = %+v, want state %v and %d counter lines", got, tt.wantState, tt.wantCounters)
+			}
+		})
+	}
+}
+
+func Test_decodeC5StateResponseKeys(t *testing.T) {
+	keys := map[string]string{"proxyState": "state", "buildVersion": "version", "counterInfos": "counters"}
+	tests := []struct {
+		name         string
+		body         string
+		keys         map[string]string
+		wantState    string
+		wantBuild    string
+		wantCounters int
+	}{
+		{"renamed keys", `{"state": "active", "version": "Version: 6.4.0.1", "counters": ["  0 TRANSPORT_MESSAGE_IN     6502      0     72"]}`, keys, "active", "Version: 6.4.0.1", 1},
+		{"renamed key wins", `{"state": "active", "proxyState": "inactive", "buildVersion": "Version: 6.2.1.12"}`, keys, "active", "Version: 6.2.1.12", 0},
+		{"ndjson", `{"state": "active", "counters": ["       Event counters       absolute   curr   last"]}
+{"counters": ["  0 TRANSPORT_MESSAGE_IN     6502      0     72"]}
+`, keys, "active", "", 2},
+		{"default keys", `{"state": "active", "proxyState": "inactive"}`, nil, "inactive", "", 0},
+		{"case-insensitive default key", `{"ProxyState": "active", "BUILDVERSION": "Version: 6.2.1.12"}`, map[string]string{"counterInfos": "counters"}, "active", "Version: 6.2.1.12", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeC5StateResponse(strings.NewReader(tt.body), tt.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ProxyState != tt.wantState || got.BuildVersion != tt.wantBuild || len(got.CounterInfos) != tt.wantCounters {
+				t.Errorf("decodeC5StateResponse() = %+v, want state %v, build %q and %d counter lines", got, tt.wantState, tt.wantBuild, tt.wantCounters)
+			}
+		})
+	}
+}
+
+func Test_c5StateResponseFields(t *testing.T) {
+	var state c5StateResponse
+	fields := state.fields()
+	for _, key := range stateResponseKeys {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("fields() missing %s", key)
+		}
+	}
+	if len(fields) != len(stateResponseKeys) {
+		t.Errorf("fields() = %d fields, want %d", len(fields), len(stateResponseKeys))
+	}
+}
+
+func Test_responseKeys(t *testing.T) {
+	defer func() { config.AppConfig.ResponseKeys = nil }()
+	config.AppConfig.ResponseKeys = map[string]map[string]string{
+		"*":         {"buildVersion": "version", "memoryUsage": "memory"},
+		"sipproxyd": {"memoryUsage": "heap", "proxyState": "state"},
+	}
+	want := map[string]string{"buildVersion": "version", "memoryUsage": "heap", "proxyState": "state"}
+	if got := responseKeys("sipproxyd"); !reflect.DeepEqual(got, want) {
+		t.Errorf("responseKeys(sipproxyd) = %v, want %v", got, want)
+	}
+	if got := responseKeys("acdqueued"); !reflect.DeepEqual(got, config.AppConfig.ResponseKeys["*"]) {
+		t.Errorf("responseKeys(acdqueued) = %v, want %v", got, config.AppConfig.ResponseKeys["*"])
+	}
+	if err := validateResponseKeys(config.AppConfig.ResponseKeys); err != nil {
+		t.Errorf("validateResponseKeys() error = %v", err)
+	}
+	for _, invalid := range []map[string]map[string]string{
+		{"unknownd": {"buildVersion": "version"}},
+		{"sipproxyd": {"BuildVersion": "version"}},
+		{"sipproxyd": {"buildVersion": ""}},
+	} {
+		if err := validateResponseKeys(invalid); err == nil {
+			t.Errorf("validateResponseKeys(%v) succeeded, want error", invalid)
+		}
+	}
+}
+
+func Test_buildApproved(t *testing.T) {
+	defer func() { config.AppConfig.ApprovedVersions = nil }()
+	tests := []struct {
+		name     string
+		approved []string
+		version  string
+		want     uint64
+	}{
+		{"no approved list", nil, "6.2.1.12", 1},
+		{"approved", []string{"6.0.2.57", "6.2.1.12"}, "6.2.1.12", 1},
+		{"unapproved", []string{"6.0.2.57"}, "6.2.1.12", 0},
+		{"unparsed version", []string{"6.0.2.57"}, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.ApprovedVersions = tt.approved
+			if got := buildApproved(tt.version); got != tt.want {
+				t.Errorf("buildApproved() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_processBaseMetricsMissingMemoryUsage(t *testing.T) {
+	defer clearMetrics("test_nomem")
+	state, err := decodeC5StateResponse(strings.NewReader(testStateResponse), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processBaseMetrics(config.Target{Prefix: "test_nomem"}, state)
+	state, err = decodeC5StateResponse(strings.NewReader(`{"proxyState": "active", "buildVersion": "Version: 6.2.1.12"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processBaseMetrics(config.Target{Prefix: "test_nomem"}, state)
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_nomem_memory_") {
+			t.Errorf("processBaseMetrics() exported %s without memory usage", name)
+		}
+	}
+	warning := `c5_parse_warnings_total{target="test_nomem",field="memoryUsage"}`
+	if got := metricSet.GetOrCreateCounter(warning).Get(); got != 1 {
+		t.Errorf("processBaseMetrics() %s = %v, want 1", warning, got)
+	}
+	if got := metricSet.GetOrCreateCounter("test_nomem_state").Get(); got != 1 {
+		t.Errorf("processBaseMetrics() state = %v, want 1", got)
+	}
+}
+
+func Test_processBaseMetricsFieldsMissing(t *testing.T) {
+	name := `c5_base_fields_missing{target="test_fields"}`
+	tests := []struct {
+		name     string
+		response string
+		want     uint64
+	}{
+		{"complete", testStateResponse, 0},
+		{"memory and queue", `{"proxyState": "active", "buildVersion": "Version: 6.2.1.12", "startupTime": "2021-01-19 04:01:04.503"}`, 2},
+		{"invalid memory and build", `{"proxyState": "active", "buildVersion": "unknown", "memoryUsage": "n/a", "tuQueueStatus": "OK", "startupTime": "2021-01-19 04:01:04.503"}`, 2},
+		{"empty", `{}`, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := decodeC5StateResponse(strings.NewReader(tt.response), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			processBaseMetrics(config.Target{Prefix: "test_fields"}, state)
+			if got := metricSet.GetOrCreateCounter(name).Get(); got != tt.want {
+				t.Errorf("processBaseMetrics() %s = %v, want %v", name, got, tt.want)
+			}
+			success := metricSet.GetOrCreateCounter(`c5_base_parse_success{target="test_fields"}`).Get()
+			if want := tt.want == 0; (success == 1) != want {
+				t.Errorf("processBaseMetrics() c5_base_parse_success = %v, want %v", success, want)
+			}
+		})
+	}
+}
+
+func Test_processBaseMetricsDaemon(t *testing.T) {
+	tests := []struct {
+		name    string
+		daemon  string
+		state   c5StateResponse
+		want    uint64
+		warning string
+	}{
+		{"any state", "", c5StateResponse{ProxyState: "active"}, 1, ""},
+		{"expected state", "registrard", c5StateResponse{RegistrarState: "active"}, 1, ""},
+		{"other state ignored", "registrard", c5StateResponse{ProxyState: "active"}, 3, "registrarState"},
+		{"queue state", "acdqueued", c5StateResponse{QueueState: "inactive"}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := "test_daemon_" + strings.ReplaceAll(tt.name, " ", "_")
+			defer clearMetrics(prefix)
+			processBaseMetrics(config.Target{Prefix: prefix, Daemon: tt.daemon}, tt.state)
+			if got := metricSet.GetOrCreateCounter(prefix + "_state").Get(); got != tt.want {
+				t.Errorf("processBaseMetrics() state = %v, want %v", got, tt.want)
+			}
+			for field := range map[string]bool{"proxyState": true, "registrarState": true, "queueState": true} {
+				var want uint64
+				if field == tt.warning {
+					want = 1
+				}
+				warning := `c5_parse_warnings_total{target="` + prefix + `",field="` + field + `"}`
+				if got := metricSet.GetOrCreateCounter(warning).Get(); got != want {
+					t.Errorf("processBaseMetrics() %s = %v, want %v", warning, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_setCounterMetricDeltas(t *testing.T) {
+	defer func() { config.AppConfig.EventCounterDeltas = "" }()
+	defer clearMetrics("test_delta_mode")
+	tests := []struct {
+		name      string
+		mode      string
+		total     uint64
+		wantDelta uint64
+		hasDelta  bool
+		hasTotal  bool
+	}{
+		{"first scrape", "alongside", 100, 0, false, true},
+		{"increase", "alongside", 130, 30, true, true},
+		{"reset", "instead", 5, 5, true, false},
+		{"unchanged", "instead", 5, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearMetrics("test_delta_mode")
+			config.AppConfig.EventCounterDeltas = tt.mode
+			setCounterMetric("test_delta_mode", eventCounter{Name: "TRANSPORT_MESSAGE_IN", Total: tt.total})
+			names := map[string]bool{}
+			for _, name := range metricSet.ListMetricNames() {
+				names[name] = true
+			}
+			if names["test_delta_mode_transport_message_in_delta"] != tt.hasDelta {
+				t.Errorf("setCounterMetric() delta exported = %v, want %v", !tt.hasDelta, tt.hasDelta)
+			}
+			if names["test_delta_mode_transport_message_in_total"] != tt.hasTotal {
+				t.Errorf("setCounterMetric() total exported = %v, want %v", !tt.hasTotal, tt.hasTotal)
+			}
+			if got := metricSet.GetOrCreateCounter("test_delta_mode_transport_message_in_delta").Get(); tt.hasDelta && got != tt.wantDelta {
+				t.Errorf("setCounterMetric() delta = %v, want %v", got, tt.wantDelta)
+			}
+		})
+	}
+}
+
+func Test_processBaseMetricsValidateMemory(t *testing.T) {
+	config.AppConfig.ValidateMemory = true
+	defer func() { config.AppConfig.ValidateMemory = false }()
+	defer clearMetrics("test_memcheck")
+	defer clearMetrics("c5_test_memcheck")
+	mismatch := metricSet.GetOrCreateCounter(`c5_memory_parse_mismatch_total{target="test_memcheck"}`)
+	tests := []struct {
+		name         string
+		memoryUsage  string
+		wantMismatch uint64
+		wantUsed     uint64
+		wantParser   string
+	}{
+		{"R6.0", "C5 Heap Health: OK  - Mem used: 18%  - Mem used: 383MB  - Mem total: 2048MB  - Max: 18% - UpdCtr: 60793", 0, 383 * mega, "string"},
+		{"R6.2", "C5 Heap Health: OK  - Mem used: 3%  76MB  (min: 76 max: 76)  - Mem total: 2048MB  - MAX: 3% - UpdCtr: 92205", 0, 76 * mega, "string"},
+		// Trailing text after the used size is only handled by the regex
+		{"unknown format", "C5 Heap Health: OK - Mem used: 12MB free - Mem total: 2048MB - Max: 1%", 1, 12 * mega, "regex"},
+		{"invalid", "C5 Heap Health: unknown", 1, 0, "none"},
+		{"missing", "", 1, 0, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processBaseMetrics(config.Target{Prefix: "test_memcheck"}, c5StateResponse{ProxyState: "active", MemoryUsage: tt.memoryUsage})
+			if got := mismatch.Get(); got != tt.wantMismatch {
+				t.Errorf("processBaseMetrics() mismatches = %v, want %v", got, tt.wantMismatch)
+			}
+			if got := metricSet.GetOrCreateCounter("test_memcheck_memory_used_bytes").Get(); got != tt.wantUsed {
+				t.Errorf("processBaseMetrics() memory used = %v, want %v", got, tt.wantUsed)
+			}
+			for _, p := range memoryParsers {
+				want := uint64(0)
+				if p == tt.wantParser {
+					want = 1
+				}
+				name := `c5_test_memcheck_memory_parser{impl="` + p + `"}`
+				if got := metricSet.GetOrCreateCounter(name).Get(); got != want {
+					t.Errorf("processBaseMetrics() %s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsFailureClearsMemoryParser(t *testing.T) {
+	var status int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer clearMetrics("test_failed")
+	defer clearMetrics("c5_test_failed")
+	defer clearMetrics(`c5_scrape_duration_seconds{target="test_failed"`)
+	target := config.Target{Prefix: "test_failed", URL: srv.URL}
+	// Details of the last successful query which are stale once it failed
+	stale := []string{
+		`c5_test_failed_memory_parser{impl="regex"}`,
+		`c5_test_failed_build_approved`,
+		`c5_test_failed_standby`,
+	}
+	defer func() { config.AppConfig.StandbyStates = nil }()
+	config.AppConfig.StandbyStates = []string{"passive"}
+	registered := func(name string) bool {
+		for _, n := range metricSet.ListMetricNames() {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, &wg)
+	for _, name := range stale {
+		if !registered(name) {
+			t.Fatalf("fetchC5StateMetrics() did not register %s", name)
+		}
+	}
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), target, &wg)
+	for _, name := range stale {
+		if registered(name) {
+			t.Errorf("fetchC5StateMetrics() kept %s of failed query", name)
+		}
+	}
+	// The duration of the failed query itself is exposed
+	if !registered(`c5_scrape_duration_seconds{target="test_failed"}`) {
+		t.Error("fetchC5StateMetrics() did not expose the duration of the failed query")
+	}
+}
+
+func Test_processBaseMetricsStandby(t *testing.T) {
+	defer func() { config.AppConfig.StandbyStates = nil }()
+	defer clearMetrics("test_standby")
+	defer clearMetrics("c5_test_standby")
+	tests := []struct {
+		name       string
+		states     []string
+		proxyState string
+		want       uint64
+		wantMetric bool
+	}{
+		{"disabled", nil, "passive", 0, false},
+		{"standby", []string{"passive", "inactive"}, "passive", 1, true},
+		{"active", []string{"passive", "inactive"}, "active", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearMetrics("test_standby")
+			clearMetrics("c5_test_standby")
+			config.AppConfig.StandbyStates = tt.states
+			processBaseMetrics(config.Target{Prefix: "test_standby"}, c5StateResponse{ProxyState: tt.proxyState})
+			found := false
+			for _, name := range metricSet.ListMetricNames() {
+				found = found || name == "c5_test_standby_standby"
+			}
+			if found != tt.wantMetric {
+				t.Fatalf("processBaseMetrics() standby metric exported = %v, want %v", found, tt.wantMetric)
+			}
+			if got := metricSet.GetOrCreateCounter("c5_test_standby_standby").Get(); tt.wantMetric && got != tt.want {
+				t.Errorf("processBaseMetrics() standby = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fetchC5StateMetricsRetries(t *testing.T) {
+	config.AppConfig.Retries = 2
+	defer func() { config.AppConfig.Retries = 0 }()
+	defer clearMetrics("test_retry")
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Drop the connection of the first request
+		if atomic.AddInt64(&requests, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fetchC5StateMetrics(context.Background(), config.Target{Prefix: "test_retry", URL: srv.URL}, &wg)
+	if got := metricSet.GetOrCreateCounter(`c5_scrape_retries_total{target="test_retry"}`).Get(); got != 1 {
+		t.Errorf("fetchC5StateMetrics() retries = %v, want 1", got)
+	}
+	if got := metricSet.GetOrCreateCounter("test_retry_state").Get(); got != 1 {
+		t.Errorf("fetchC5StateMetrics() state after retry = %v, want 1", got)
+	}
+}
+
+func Test_parseUsageCounterColumns(t *testing.T) {
+	defer func() { config.AppConfig.UsageColumns = nil }()
+	line := " 45 CALL_CONTROL_ACTIVE_CALLS                           1      2      3      4      5      6"
+	tests := []struct {
+		name    string
+		columns []int
+		want    usageCounter
+	}{
+		{"default", nil, usageCounter{ID: "45", Name: "CALL_CONTROL_ACTIVE_CALLS", Current: 1, LastMin: 4, LastMax: 5, LastAvg: 6}},
+		{"reordered", []int{0, 1, 2, 5}, usageCounter{ID: "45", Name: "CALL_CONTROL_ACTIVE_CALLS", Current: 1, LastMin: 2, LastMax: 3, LastAvg: 6}},
+		{"out of line", []int{0, 3, 4, 6}, usageCounter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.UsageColumns = tt.columns
+			if got := parseUsageCounter(line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUsageCounter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateUsageColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []int
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"valid", []int{0, 1, 2, 3}, false},
+		{"too few", []int{0, 1}, true},
+		{"negative", []int{0, -1, 2, 3}, true},
+		{"too large", []int{0, 1, 2, 99}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUsageColumns(&config.AppConfiguration{UsageColumns: tt.columns})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUsageColumns() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_processC5StateCounterNonNumericID(t *testing.T) {
+	defer clearMetrics("test_ids")
+	processC5StateCounter("test_ids", "", counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"  SECTION GENERAL                                        1      2      3",
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		"  xx CALL_CONTROL_ACTIVE_CALLS                          4      0      0      0      0      0",
+		[]interface{}{
+			" ab TRANSACTION_AND_TU_TU_MANAGER_QUEUE_SIZE          0      0      0      0      0      0",
+			"                                                      0      0      0      0      0      0",
+		},
+	))
+	var got []string
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_ids") {
+			got = append(got, name)
+		}
+	}
+	if want := []string{"test_ids_transport_message_in_total"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processC5StateCounter() metrics = %v, want %v", got, want)
+	}
+}
+
+func Test_counterSection(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"  Transport", "Transport"},
+		{"   Transport Layer:", "Transport_Layer"},
+		{"  SECTION GENERAL", "SECTION_GENERAL"},
+		{"  0 TRANSPORT_MESSAGE_IN                              6502      0     72", ""},
+		{"    OBSERVERS  (dialog,csta,reg):  36,0,0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := counterSection(tt.line); got != tt.want {
+			t.Errorf("counterSection(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func Test_processC5StateCounterSections(t *testing.T) {
+	defer func() { config.AppConfig.CounterSections = "" }()
+	lines := counterInfos(
+		"       Event counters                              absolute   curr   last",
+		"  0 TRANSPORT_MESSAGE_IN                              6502      0     72",
+		"  Transport:",
+		"  1 TRANSPORT_MESSAGE_OUT                             6501      0     72",
+		"  Dialog Layer",
+		[]interface{}{
+			"425 CASS_ERR_CONN_TMO                                    1      0      0",
+			"                                                         2    386    518",
+		},
+		"       Usage counters                              current    min    max   lMin   lMax   lAvg",
+		" 45 CALL_CONTROL_ACTIVE_CALLS                           3      0      0      0      0      0",
+	)
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"", []string{
+			"test_sections_call_control_active_calls_current",
+			`test_sections_cass_err_conn_tmo_total{idx="1"}`,
+			"test_sections_transport_message_in_total",
+			"test_sections_transport_message_out_total",
+		}},
+		{"name", []string{
+			"test_sections_call_control_active_calls_current",
+			`test_sections_dialog_layer_cass_err_conn_tmo_total{idx="1"}`,
+			"test_sections_transport_message_in_total",
+			"test_sections_transport_transport_message_out_total",
+		}},
+		{"label", []string{
+			"test_sections_call_control_active_calls_current",
+			`test_sections_cass_err_conn_tmo_total{section="dialog_layer",idx="1"}`,
+			"test_sections_transport_message_in_total",
+			`test_sections_transport_message_out_total{section="transport"}`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			config.AppConfig.CounterSections = tt.mode
+			defer clearMetrics("test_sections")
+			processC5StateCounter("test_sections", "", lines)
+			registered := map[string]bool{}
+			for _, name := range metricSet.ListMetricNames() {
+				registered[name] = true
+			}
+			for _, name := range tt.want {
+				if !registered[name] {
+					t.Errorf("processC5StateCounter() with counterSections = %q did not export %s", tt.mode, name)
+				}
+			}
+		})
+	}
+}
+
+func Test_isCounterLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"  0 TRANSPORT_MESSAGE_IN                              6502      0     72", true},
+		{"425 CASS_ERR_CONN_TMO                                  0      0      0", true},
+		{"  SECTION GENERAL", false},
+		{"  -1 NEGATIVE_ID                                     1      0      0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCounterLine(tt.line); got != tt.want {
+			t.Errorf("isCounterLine(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func Test_handleReady(t *testing.T) {
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "down") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	defer setTargets(currentTargets())
+	defer clearMetrics("test_ready")
+	defer func() { config.AppConfig.ReadyTargets = "" }()
+	srv := httptest.NewServer(newMetricsHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		mode    string
+		targets []config.Target
+		status  int
+		body    string
+	}{
+		{"all scraped", "all", []config.Target{{Prefix: "test_ready1", URL: c5.URL + "/up"}}, http.StatusOK, "ready\n"},
+		{"one failing", "all", []config.Target{{Prefix: "test_ready1", URL: c5.URL + "/up"}, {Prefix: "test_ready2", URL: c5.URL + "/down"}}, http.StatusServiceUnavailable, "test_ready2 not scraped successfully\n"},
+		{"any scraped", "any", []config.Target{{Prefix: "test_ready1", URL: c5.URL + "/up"}, {Prefix: "test_ready2", URL: c5.URL + "/down"}}, http.StatusOK, "ready\n"},
+		{"none scraped", "any", []config.Target{{Prefix: "test_ready2", URL: c5.URL + "/down"}}, http.StatusServiceUnavailable, "test_ready2 not scraped successfully\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.AppConfig.ReadyTargets = tt.mode
+			setTargets(tt.targets)
+			resp, err := http.Get(srv.URL + "/-/ready")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("/-/ready = %v %q, want %v %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func Test_newMetricsHandlerGzip(t *testing.T) {
+	c5 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStateResponse))
+	}))
+	defer c5.Close()
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_gzip", URL: c5.URL}})
+	srv := httptest.NewServer(newMetricsHandler())
+	defer srv.Close()
+
+	for _, encoding := range []string{"", "gzip"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", srv.URL+"/metrics", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			// Use a transport not decompressing transparently
+			resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			var body io.Reader = resp.Body
+			if encoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "\ntest_gzip_transport_message_in_total 6502\n") {
+				t.Errorf("metrics miss test_gzip_transport_message_in_total:\n%s", data)
+			}
+		})
+	}
+}
+
+func Test_acceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0, identity", false},
+		{"*", true},
+		{"gzip;q=0, *", false},
+		{"x-gzip-custom", false},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+// Transports of targets queried through a proxy, by proxy URL
+var (
+	proxyTransportsMu sync.Mutex
+	proxyTransports   = map[string]*http.Transport{}
+)
+
+// parseProxyURL validates the proxy URL of a target. Only plain HTTP proxies
+// are supported, the port defaults to 80.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// The parse error contains the whole URL including the password
+		return nil, fmt.Errorf("invalid proxy %s, expected http://[user:password@]host[:port]", redactProxy(proxy))
+	}
+	if u.Scheme != "http" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q, expected http://[user:password@]host[:port]", u.Redacted())
+	}
+	return u, nil
+}
+
+// redactProxy masks the password of a proxy URL for logging
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
+
+// redactConfig returns a copy of the configuration for logging, with the
+// passwords of the target proxies masked
+func redactConfig(conf *config.AppConfiguration) config.AppConfiguration {
+	c := *conf
+	c.Targets = make([]config.Target, len(conf.Targets))
+	for i, t := range conf.Targets {
+		if t.Proxy != "" {
+			t.Proxy = redactProxy(t.Proxy)
+		}
+		c.Targets[i] = t
+	}
+	return c
+}
+
+// transportFor returns the transport used to query a target. Targets with
+// a proxy use a separate transport per proxy, derived from c5Transport.
+func transportFor(target config.Target) (http.RoundTripper, error) {
+	if target.Proxy == "" {
+		if c5Transport == nil {
+			return http.DefaultTransport, nil
+		}
+		return c5Transport, nil
+	}
+	proxyTransportsMu.Lock()
+	defer proxyTransportsMu.Unlock()
+	if tr, ok := proxyTransports[target.Proxy]; ok {
+		return tr, nil
+	}
+	proxy, err := parseProxyURL(target.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	base := c5Transport
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	tr := newTunnelTransport(base, proxy)
+	proxyTransports[target.Proxy] = tr
+	return tr, nil
+}
+
+// pruneProxyTransports closes the transports of proxies no longer used by
+// any of the given targets
+func pruneProxyTransports(list []config.Target) {
+	used := map[string]bool{}
+	for _, t := range list {
+		used[t.Proxy] = true
+	}
+	proxyTransportsMu.Lock()
+	defer proxyTransportsMu.Unlock()
+	for proxy, tr := range proxyTransports {
+		if !used[proxy] {
+			tr.CloseIdleConnections()
+			delete(proxyTransports, proxy)
+		}
+	}
+}
+
+// newTunnelTransport returns a transport opening every connection as
+// CONNECT tunnel through the proxy, also for plain HTTP targets. Credentials
+// of the proxy URL are sent as Proxy-Authorization header.
+func newTunnelTransport(base *http.Transport, proxy *url.URL) *http.Transport {
+	tr := base.Clone()
+	tr.Proxy = nil
+	tr.ProxyConnectHeader = http.Header{}
+	if proxy.User != nil {
+		pwd, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pwd))
+		tr.ProxyConnectHeader.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	tr.DialContext = withConnectTimeout(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialTunnel(ctx, dialer, proxyAddr, addr, tr.ProxyConnectHeader)
+	}, config.AppConfig.ConnectTimeout.Duration)
+	return tr
+}
+
+// dialTunnel connects to addr using a CONNECT request to the proxy
+func dialTunnel(ctx context.Context, dialer *net.Dialer, proxyAddr, addr string, header http.Header) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: header,
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused tunnel to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
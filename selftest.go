@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+// Real world responses of C5 processes used for the parser self-test
+//
+//go:embed resources/samples/*.json
+var samples embed.FS
+
+// Prefix of the private targets the samples are processed with, so the state
+// of configured targets like sipproxyd is not touched
+const selftestPrefix = "selftest_"
+
+// Expected metric values per embedded sample
+var selftestExpectations = map[string]map[string]uint64{
+	"sipproxyd-r6.0.json": {
+		`selftest_sipproxyd_info{version="6.0.2.57",starttime="2020-01-19 04:01:04.503"}`: 1,
+		`selftest_sipproxyd_state`:                                                     1,
+		`selftest_sipproxyd_tu_queue_state`:                                            1,
+		`selftest_sipproxyd_memory_used_bytes`:                                         57 * 1024 * 1024,
+		`selftest_sipproxyd_memory_total_bytes`:                                        2048 * 1024 * 1024,
+		`selftest_sipproxyd_memory_max_used_percent`:                                   3,
+		`selftest_sipproxyd_transport_message_in_total`:                                6502,
+		`selftest_sipproxyd_snmp_requests_total`:                                       908,
+		`selftest_sipproxyd_ws_connections_current`:                                    6,
+		`selftest_sipproxyd_transaction_and_tu_tu_manager_queue_size_lastmax{idx="2"}`: 1,
+	},
+	"registrard-r6.2.json": {
+		`selftest_registrard_info{version="6.2.1.12",starttime="2021-02-28 02:14:51.112"}`: 1,
+		`selftest_registrard_state`:                                                     1,
+		`selftest_registrard_memory_used_bytes`:                                         76 * 1024 * 1024,
+		`selftest_registrard_memory_total_bytes`:                                        2048 * 1024 * 1024,
+		`selftest_registrard_memory_max_used_percent`:                                   3,
+		`selftest_registrard_request_method_register_in_total`:                          40211,
+		`selftest_registrard_cass_err_conn_tmo_total{idx="1"}`:                          2,
+		`selftest_registrard_presence_active_subscriptions_current`:                     36,
+		`selftest_registrard_cluster_active_registrations_lastavg`:                      1522,
+		`selftest_registrard_transaction_and_tu_tu_manager_queue_size_lastmax{idx="0"}`: 9,
+	},
+}
+
+// sampleNames returns the file names of all embedded samples
+func sampleNames() []string {
+	entries, err := samples.ReadDir("resources/samples")
+	if err != nil {
+		panic(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readSample decodes an embedded sample, returning the type of the process
+// derived from the file name, e.g. sipproxyd-r6.0.json
+func readSample(name string) (string, c5StateResponse, error) {
+	data, err := samples.ReadFile(path.Join("resources/samples", name))
+	if err != nil {
+		return "", c5StateResponse{}, err
+	}
+	state, err := decodeC5StateResponse(bytes.NewReader(data), nil)
+	return strings.SplitN(name, "-", 2)[0], state, err
+}
+
+// processSample runs the parser over an embedded sample using a separate
+// metric set and a private selftest_ prefix, whose target state is dropped
+// afterwards. As the global metric set is replaced meanwhile, it must only
+// be used by the self-test and tests, never while serving metrics.
+func processSample(name string) (*metrics.Set, counterStats, error) {
+	daemon, state, err := readSample(name)
+	if err != nil {
+		return nil, counterStats{}, err
+	}
+	prefix := selftestPrefix + daemon
+
+	defaultSet := metricSet
+	defer func() { metricSet = defaultSet }()
+	defer dropTargetState(prefix)
+	metricSet = metrics.NewSet()
+	processBaseMetrics(config.Target{Prefix: prefix, Daemon: daemon}, state)
+	stats := processC5StateCounter(prefix, daemon, state.CounterInfos)
+	return metricSet, stats, nil
+}
+
+// knownCounterNames returns the names of all counters of the embedded samples
+func knownCounterNames() map[string]bool {
+	names := map[string]bool{}
+	for _, name := range sampleNames() {
+		_, state, err := readSample(name)
+		if err != nil {
+			panic(err)
+		}
+		for _, n := range counterNames(state.CounterInfos) {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// counterNames returns the names of the event and usage counters of a state
+// response like processC5StateCounter, but without exporting any metrics
+func counterNames(lines []json.RawMessage) []string {
+	var names []string
+	var cntType string
+	for _, raw := range lines {
+		info, ok := decodeCounterInfo(raw)
+		if !ok {
+			continue
+		}
+		l := info.line
+		if info.multiline {
+			if len(info.sublines) == 0 {
+				continue
+			}
+			l = info.sublines[0]
+		}
+		l, _ = normalizeCounterLine(l)
+		if header := counterHeaderType(l); header != "" && !info.multiline {
+			cntType = header
+			continue
+		}
+		parts := strings.Fields(l)
+		if cntType == "" || len(parts) < 3 || !isCounterLine(l) || (!info.multiline && strings.HasPrefix(l, "    ")) {
+			continue
+		}
+		if name := normalizeMetricName(parts[1]); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// runSelftest parses all embedded samples and verifies the expected metrics
+// have been produced. It returns false if any check failed or a sample has no
+// expected metrics.
+func runSelftest() bool {
+	passed := true
+	for _, name := range sampleNames() {
+		expected, ok := selftestExpectations[name]
+		if !ok {
+			// A sample nobody checks would always pass
+			fmt.Printf("FAIL %s: no expected metrics defined\n", name)
+			passed = false
+			continue
+		}
+		set, _, err := processSample(name)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			passed = false
+			continue
+		}
+		registered := map[string]bool{}
+		for _, m := range set.ListMetricNames() {
+			registered[m] = true
+		}
+		failed := 0
+		for metric, want := range expected {
+			if !registered[metric] {
+				fmt.Printf("FAIL %s: missing %s\n", name, metric)
+				failed++
+			} else if got := set.GetOrCreateCounter(metric).Get(); got != want {
+				fmt.Printf("FAIL %s: %s = %d, want %d\n", name, metric, got, want)
+				failed++
+			}
+		}
+		if failed > 0 {
+			passed = false
+			continue
+		}
+		fmt.Printf("PASS %s: %d metrics\n", name, len(registered))
+	}
+	return passed
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Expected Prometheus output per embedded sample, regenerate using
+// go test -run Test_processSampleGolden -update-golden
+//
+//go:embed testdata/golden/*.prom
+var goldens embed.FS
+
+var updateGolden = flag.Bool("update-golden", false, "Rewrite the golden files of the sample output")
+
+func Test_runSelftest(t *testing.T) {
+	if len(sampleNames()) < 2 {
+		t.Fatalf("sampleNames() = %v, want R6.0 and R6.2 samples", sampleNames())
+	}
+	if !runSelftest() {
+		t.Error("runSelftest() failed")
+	}
+}
+
+func Test_runSelftestWithoutExpectations(t *testing.T) {
+	name := sampleNames()[0]
+	expected := selftestExpectations[name]
+	delete(selftestExpectations, name)
+	defer func() { selftestExpectations[name] = expected }()
+	if runSelftest() {
+		t.Errorf("runSelftest() passed without expectations of %s", name)
+	}
+}
+
+func Test_processSampleGolden(t *testing.T) {
+	for _, name := range sampleNames() {
+		t.Run(name, func(t *testing.T) {
+			set, _, err := processSample(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			set.WritePrometheus(&got)
+			file := path.Join("testdata/golden", strings.TrimSuffix(name, ".json")+".prom")
+			if *updateGolden {
+				if err := ioutil.WriteFile(file, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := goldens.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffLines(string(want), got.String()); diff != "" {
+				t.Errorf("processSample(%s) output differs from %s:\n%s", name, file, diff)
+			}
+		})
+	}
+}
+
+func Test_knownCounterNames(t *testing.T) {
+	want := map[string]bool{}
+	for _, name := range sampleNames() {
+		_, stats, err := processSample(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := range stats.names {
+			want[n] = true
+		}
+	}
+	if got := knownCounterNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("knownCounterNames() = %v, want the names processed %v", got, want)
+	}
+}
+
+func Test_processSampleIsolated(t *testing.T) {
+	before := len(metricSet.ListMetricNames())
+	for _, name := range sampleNames() {
+		if _, _, err := processSample(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	knownCounterNames()
+	if got := len(metricSet.ListMetricNames()); got != before {
+		t.Errorf("processSample() changed the global metric set from %d to %d series", before, got)
+	}
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	for prefix := range states {
+		if strings.HasPrefix(prefix, selftestPrefix) {
+			t.Errorf("processSample() kept target state of %s", prefix)
+		}
+	}
+}
+
+// diffLines lists the lines only found in one of both outputs
+func diffLines(want, got string) string {
+	count := map[string]int{}
+	for _, l := range strings.Split(want, "\n") {
+		count[l]++
+	}
+	for _, l := range strings.Split(got, "\n") {
+		count[l]--
+	}
+	var diff []string
+	for _, l := range strings.Split(want, "\n") {
+		if count[l] > 0 {
+			diff = append(diff, "- "+l)
+			count[l]--
+		}
+	}
+	for _, l := range strings.Split(got, "\n") {
+		if count[l] < 0 {
+			diff = append(diff, "+ "+l)
+			count[l]++
+		}
+	}
+	return strings.Join(diff, "\n")
+}
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+	"github.com/jinzhu/configor"
+)
+
+// Currently active list of C5 state targets and their prefixes, replaced on
+// reload
+var (
+	targetsMu      sync.RWMutex
+	targets        []config.Target
+	targetPrefixes []string
+)
+
+var prefixRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Namespaces of the metrics of the exporter itself, of XMS and of the private
+// selftest and /debug/delta targets, which a target prefix must not overlap
+var reservedPrefixes = []string{"c5", "xms", "go", "process", "selftest", "debug_delta"}
+
+// reservedPrefix returns the reserved namespace overlapped by the prefix.
+// Metrics of a target are cleared by prefix, so e.g. "c" would also clear
+// the c5_ metrics.
+func reservedPrefix(prefix string) (string, bool) {
+	for _, ns := range reservedPrefixes {
+		if prefix == ns || strings.HasPrefix(prefix, ns+"_") || strings.HasPrefix(ns, prefix) {
+			return ns, true
+		}
+	}
+	return "", false
+}
+
+// Host and ports given on the commandline to adjust the default C5 URLs
+var addressFlags struct {
+	host           string
+	sipproxydPort  int
+	acdqueuedPort  int
+	registrardPort int
+}
+
+// targetState keeps information about previous scrapes of a target
+type targetState struct {
+	mu          sync.Mutex
+	startupTime string            // Startup time of the C5 process at the last scrape
+	counters    map[string]bool   // Counter names seen at the last scrape
+	totals      map[string]uint64 // Event counter totals of the last scrape by metric name
+	updated     map[string]bool   // Metric names of the totals updated by the current scrape
+	lastQuery   time.Time         // Start of the last query of the C5 process
+	scrapedAt   time.Time         // Time of the last successful query
+	version     string            // Build version parsed at the last successful query
+	processes   map[string]bool   // Prefixes of the processes of a bundle at the last query
+
+	disabledUntil time.Time // End of a maintenance window without queries
+	succeeded     bool      // Any query succeeded since startup or a change of the target
+	lastSuccess   bool      // The last query succeeded
+}
+
+var (
+	statesMu sync.Mutex
+	states   = map[string]*targetState{}
+)
+
+func stateFor(prefix string) *targetState {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	st, ok := states[prefix]
+	if !ok {
+		st = &targetState{}
+		states[prefix] = st
+	}
+	return st
+}
+
+// trackVanishedCounters compares the counter names of a successful scrape
+// with the previous one and counts names that disappeared. Tracking is reset
+// whenever the C5 process has been restarted. Event counter totals not updated
+// by the scrape are dropped.
+func trackVanishedCounters(prefix, startupTime string, names map[string]bool) {
+	vanished := getCounter(`c5_counters_vanished_total{target="` + prefix + `"}`)
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.counters != nil && st.startupTime == startupTime {
+		for name := range st.counters {
+			if !names[name] {
+				logError("Counter", name, "of", prefix, "vanished since last scrape")
+				vanished.Inc()
+			}
+		}
+	}
+	st.startupTime = startupTime
+	st.counters = names
+	// Drop the totals of vanished counters
+	for name := range st.totals {
+		if !st.updated[name] {
+			delete(st.totals, name)
+		}
+	}
+	st.updated = nil
+}
+
+// eventCounterDelta returns the difference of an event counter total to the
+// previous scrape. It returns false on the first scrape. After a reset of the
+// counter the new total is returned.
+func eventCounterDelta(prefix, name string, total uint64) (uint64, bool) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.totals == nil {
+		st.totals = map[string]uint64{}
+	}
+	if st.updated == nil {
+		st.updated = map[string]bool{}
+	}
+	prev, ok := st.totals[name]
+	st.totals[name] = total
+	st.updated[name] = true
+	if !ok {
+		return 0, false
+	}
+	if total < prev {
+		return total, true
+	}
+	return total - prev, true
+}
+
+// setScrapedAt records the time the current metrics of a target were queried
+func setScrapedAt(prefix string, t time.Time) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.scrapedAt = t
+}
+
+// scrapeTimestamps returns the time of the last successful query in
+// milliseconds per prefix of the current targets
+func scrapeTimestamps() map[string]int64 {
+	times := map[string]int64{}
+	for _, t := range currentTargets() {
+		st := stateFor(t.Prefix)
+		st.mu.Lock()
+		if !st.scrapedAt.IsZero() {
+			times[t.Prefix] = st.scrapedAt.UnixNano() / int64(time.Millisecond)
+		}
+		st.mu.Unlock()
+	}
+	return times
+}
+
+// dropTargetState forgets all state kept about previous scrapes of a target
+func dropTargetState(prefix string) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	delete(states, prefix)
+	forgetByteCounters(prefix)
+	forgetQueueDepthTrends(prefix)
+}
+
+// setBuildVersion records the build version of a target, empty if it could
+// not be parsed
+func setBuildVersion(prefix, version string) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.version = version
+}
+
+// forgetBuildVersions drops the build versions of all targets starting with
+// the prefix, once their metrics have been cleared
+func forgetBuildVersions(prefix string) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	for p, st := range states {
+		if strings.HasPrefix(p, prefix) {
+			st.mu.Lock()
+			st.version = ""
+			st.mu.Unlock()
+		}
+	}
+}
+
+// setBuildsSeen exposes the number of targets per build version, to show
+// the version spread of the processes covered by the exporter
+func setBuildsSeen() {
+	counts := map[string]uint64{}
+	statesMu.Lock()
+	for prefix, st := range states {
+		if setFor(prefix) != metricSet {
+			continue // Queried privately, e.g. by /debug/delta
+		}
+		st.mu.Lock()
+		if st.version != "" {
+			counts[`c5_builds_seen{version="`+st.version+`"}`]++
+		}
+		st.mu.Unlock()
+	}
+	statesMu.Unlock()
+	for _, name := range metricSet.ListMetricNames() {
+		if _, ok := counts[name]; !ok && strings.HasPrefix(name, "c5_builds_seen{") {
+			metricSet.UnregisterMetric(name)
+		}
+	}
+	for name, n := range counts {
+		getCounter(name).Set(n)
+	}
+}
+
+// Names of the series registered per target prefix, only tracked if
+// maxSeriesPerTarget is set
+var (
+	seriesMu sync.Mutex
+	series   = map[string]map[string]bool{}
+)
+
+// allowSeries returns false if registering the given metric would exceed
+// the maximum number of series of its target. Existing series are always
+// updated, metrics not belonging to a target are not limited.
+func allowSeries(name string) bool {
+	limit := config.AppConfig.MaxSeriesPerTarget
+	if limit <= 0 {
+		return true
+	}
+	prefix := longestPrefix(name, currentPrefixes())
+	if prefix == "" {
+		return true
+	}
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	names, ok := series[prefix]
+	if !ok {
+		names = map[string]bool{}
+		series[prefix] = names
+	}
+	if names[name] {
+		return true
+	}
+	if len(names) >= limit {
+		logDebug("Dropping series", name, "exceeding the limit of", limit, "series of", prefix)
+		getCounter(`c5_series_limit_hit_total{target="` + prefix + `"}`).Inc()
+		return false
+	}
+	names[name] = true
+	return true
+}
+
+// forgetSeries stops tracking the series with the given name prefix, once
+// they have been unregistered
+func forgetSeries(prefix string) {
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	for _, names := range series {
+		for name := range names {
+			if strings.HasPrefix(name, prefix) {
+				delete(names, name)
+			}
+		}
+	}
+}
+
+// forgetVanishedProcesses clears all metrics of the processes of a bundle
+// target missing in its latest response, as they won't be updated anymore
+func forgetVanishedProcesses(bundle string, processes []config.Target) {
+	current := map[string]bool{}
+	for _, p := range processes {
+		current[p.Prefix] = true
+	}
+	st := stateFor(bundle)
+	st.mu.Lock()
+	previous := st.processes
+	st.processes = current
+	st.mu.Unlock()
+	for prefix := range previous {
+		if !current[prefix] {
+			logInfo("Process", prefix, "vanished from bundle", bundle)
+			clearProcessMetrics(prefix)
+		}
+	}
+}
+
+// clearProcessMetrics removes the metrics of a process including the exporter
+// metrics labeled with it, and drops its state
+func clearProcessMetrics(prefix string) {
+	clearMetrics(prefix)
+	clearMetrics(`c5_` + prefix + `_`)
+	label := `target="` + prefix + `"`
+	set := setFor(prefix)
+	for _, name := range set.ListMetricNames() {
+		if strings.Contains(name, "{"+label) || strings.Contains(name, ","+label) {
+			set.UnregisterMetric(name)
+		}
+	}
+	dropTargetState(prefix)
+}
+
+// unregisterSeries unregisters all series of the metric with the given name
+func unregisterSeries(name string) {
+	matches := func(n string) bool {
+		return n == name || strings.HasPrefix(n, name+"{")
+	}
+	set := setFor(name)
+	for _, n := range set.ListMetricNames() {
+		if matches(n) {
+			set.UnregisterMetric(n)
+		}
+	}
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	for _, names := range series {
+		for n := range names {
+			if matches(n) {
+				delete(names, n)
+			}
+		}
+	}
+}
+
+// setNeverSucceeded records the result of the last query of a target and
+// exposes whether no query succeeded since startup or since the target was
+// changed, which distinguishes misconfigured targets from temporarily failing
+// ones
+func setNeverSucceeded(prefix string, success bool) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.succeeded = st.succeeded || success
+	st.lastSuccess = success
+	setParseSuccess(`c5_target_never_succeeded{target="`+prefix+`"}`, !st.succeeded)
+}
+
+// targetSucceeded returns true if any query of the target succeeded since
+// startup or since the target was changed
+func targetSucceeded(prefix string) bool {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.succeeded
+}
+
+// lastScrapeSucceeded returns true if the last query of the target
+// succeeded. Unlike c5_scrape_success it is not exposed, so it can be read
+// for targets disabled or removed meanwhile.
+func lastScrapeSucceeded(prefix string) bool {
+	statesMu.Lock()
+	st, ok := states[prefix]
+	statesMu.Unlock()
+	if !ok {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.lastSuccess
+}
+
+// resetNeverSucceeded forgets previous successful queries of a changed or
+// removed target
+func resetNeverSucceeded(prefix string) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.succeeded = false
+	unregisterMetric(`c5_target_never_succeeded{target="` + prefix + `"}`)
+}
+
+// disableTarget stops querying a target until the given time, e.g. during a
+// planned restart of the C5 process
+func disableTarget(prefix string, until time.Time) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.disabledUntil = until
+	getCounter(`c5_target_disabled{target="` + prefix + `"}`).Set(1)
+	logInfo("Disabled scraping of", prefix, "until", until.Format(time.RFC3339))
+}
+
+// enableTarget resumes querying a disabled target
+func enableTarget(prefix string) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.disabledUntil = time.Time{}
+	getCounter(`c5_target_disabled{target="` + prefix + `"}`).Set(0)
+	logInfo("Enabled scraping of", prefix)
+}
+
+// scrapeDisabled returns true if the target must not be queried. Targets
+// are enabled again once the time given to disableTarget passed.
+func scrapeDisabled(prefix string) bool {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.disabledUntil.IsZero() {
+		return false
+	}
+	if time.Now().Before(st.disabledUntil) {
+		return true
+	}
+	st.disabledUntil = time.Time{}
+	getCounter(`c5_target_disabled{target="` + prefix + `"}`).Set(0)
+	logInfo("Enabled scraping of", prefix, "after maintenance window")
+	return false
+}
+
+// resetScrapeThrottle lets the next scrape of a target query the C5 process
+// regardless of the minimum scrape interval
+func resetScrapeThrottle(prefix string) {
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastQuery = time.Time{}
+}
+
+// throttleScrape returns true if the target was queried less than the
+// configured minimum scrape interval ago, so the metrics of that query are
+// served again. Otherwise the start of the new query is recorded.
+func throttleScrape(prefix string) bool {
+	interval := config.AppConfig.MinScrapeInterval.Duration
+	if interval <= 0 {
+		return false
+	}
+	cached := getCounter(`c5_scrape_cached{target="` + prefix + `"}`)
+	st := stateFor(prefix)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	if !st.lastQuery.IsZero() && now.Sub(st.lastQuery) < interval {
+		logDebug("Serving metrics of last query of", prefix)
+		cached.Set(1)
+		return true
+	}
+	st.lastQuery = now
+	cached.Set(0)
+	return false
+}
+
+// Scrapes currently in progress, closed once finished
+var (
+	inProgressMu sync.Mutex
+	inProgress   = map[string]chan struct{}{}
+)
+
+// trackScrapeGoroutine counts the running queries including those waiting
+// for a scrape in progress, so leaked goroutines of targets never returning
+// become visible. The returned function must be deferred.
+func trackScrapeGoroutine() func() {
+	active := getCounter("c5_active_scrape_goroutines")
+	active.Inc()
+	return active.Dec
+}
+
+// beginScrape avoids concurrent queries of the same C5 URL, e.g. by multiple
+// Prometheus servers. It returns true if the caller should query the URL and
+// must call done afterwards. Otherwise a scrape was already in progress and
+// beginScrape waited for it to finish, so its result can be used.
+func beginScrape(prefix, url string) (first bool, done func()) {
+	key := prefix + " " + url
+	inProgressMu.Lock()
+	if ch, ok := inProgress[key]; ok {
+		inProgressMu.Unlock()
+		logDebug("Waiting for scrape in progress of", prefix, url)
+		<-ch
+		return false, nil
+	}
+	ch := make(chan struct{})
+	inProgress[key] = ch
+	inProgressMu.Unlock()
+	return true, func() {
+		inProgressMu.Lock()
+		delete(inProgress, key)
+		inProgressMu.Unlock()
+		close(ch)
+	}
+}
+
+func currentTargets() []config.Target {
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+	return targets
+}
+
+// currentPrefixes returns the prefixes of the active targets. The returned
+// slice is shared and must not be modified.
+func currentPrefixes() []string {
+	targetsMu.RLock()
+	defer targetsMu.RUnlock()
+	return targetPrefixes
+}
+
+func setTargets(t []config.Target) {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	targets = t
+	targetPrefixes = make([]string, len(t))
+	for i, target := range t {
+		targetPrefixes[i] = target.Prefix
+	}
+	updateTargetContexts(t)
+	pruneProxyTransports(t)
+}
+
+// targetContext is cancelled once its target is removed or changed
+type targetContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	hash   string
+}
+
+// Contexts of the active targets by prefix
+var (
+	targetContextsMu sync.Mutex
+	targetContexts   = map[string]targetContext{}
+)
+
+// updateTargetContexts cancels the contexts of removed and changed targets,
+// aborting their scrapes in progress, and creates contexts for new ones.
+// Metrics of removed targets are cleared, as they won't be updated anymore.
+func updateTargetContexts(list []config.Target) {
+	targetContextsMu.Lock()
+	defer targetContextsMu.Unlock()
+	hashes := map[string]string{}
+	for _, t := range list {
+		hashes[t.Prefix] = hashTargets([]config.Target{t})
+	}
+	for prefix, tc := range targetContexts {
+		if hash, ok := hashes[prefix]; !ok || hash != tc.hash {
+			tc.cancel()
+			delete(targetContexts, prefix)
+			resetNeverSucceeded(prefix)
+			if !ok {
+				clearMetrics(prefix)
+				clearScrapeStatus(prefix)
+				unregisterMetric(`c5_target_disabled{target="` + prefix + `"}`)
+				unregisterMetric(`c5_scrape_timeout_seconds{target="` + prefix + `"}`)
+			}
+		}
+	}
+	for prefix, hash := range hashes {
+		if _, ok := targetContexts[prefix]; !ok {
+			ctx, cancel := context.WithCancel(context.Background())
+			targetContexts[prefix] = targetContext{ctx, cancel, hash}
+		}
+	}
+}
+
+// withTargetContext returns a context of ctx, which is additionally cancelled
+// if the target is removed or changed. cancel must be called afterwards.
+func withTargetContext(ctx context.Context, prefix string) (context.Context, context.CancelFunc) {
+	targetContextsMu.Lock()
+	tc, ok := targetContexts[prefix]
+	targetContextsMu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	if ok {
+		go func() {
+			select {
+			case <-tc.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// scrapeParallelism returns the number of targets queried at once, which
+// defaults to GOMAXPROCS to respect the CPU limit of containers.
+func scrapeParallelism() int {
+	if config.AppConfig.ScrapeParallelism > 0 {
+		return config.AppConfig.ScrapeParallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Time granted in addition to the largest timeout before a scrape is finished
+// without the targets still in progress
+const scrapeGrace = 500 * time.Millisecond
+
+// scrapeDeadline returns the time after which a scrape is finished
+func scrapeDeadline() time.Duration {
+	max := timeoutFor(config.Target{})
+	for _, t := range currentTargets() {
+		if timeout := timeoutFor(t); timeout > max {
+			max = timeout
+		}
+	}
+	return max + scrapeGrace
+}
+
+// scrapeOutput guards writing the metrics of a target queried by
+// scrapeTargets, so a query finishing after the deadline can't register
+// series of a target already counted as failed
+type scrapeOutput struct {
+	mu   sync.Mutex
+	done bool // The metrics of the query have been written
+	late bool // The deadline passed, the response must be dropped
+}
+
+type scrapeOutputKey struct{}
+
+// lockScrapeOutput must be called before writing the metrics of a response.
+// It returns false if the deadline of the scrape passed already, otherwise
+// the metrics may be written until release is called.
+func lockScrapeOutput(ctx context.Context) (release func(), ok bool) {
+	out, _ := ctx.Value(scrapeOutputKey{}).(*scrapeOutput)
+	if out == nil {
+		// Queried outside of scrapeTargets, e.g. by the debug endpoints
+		return func() {}, ctx.Err() == nil
+	}
+	out.mu.Lock()
+	if out.late || ctx.Err() != nil {
+		out.mu.Unlock()
+		return nil, false
+	}
+	return func() {
+		out.done = true
+		out.mu.Unlock()
+	}, true
+}
+
+// scrapeTargets queries the given targets using at most parallelism workers.
+// It returns once all targets have been queried or ctx is done. Targets still
+// in progress then are counted as failed and their possibly outdated metrics
+// are removed, instead of letting a single hanging target block the scrape.
+func scrapeTargets(ctx context.Context, list []config.Target, parallelism int) {
+	var mu sync.Mutex
+	pending := map[string]*scrapeOutput{}
+	outputs := make([]*scrapeOutput, len(list))
+	for i, t := range list {
+		outputs[i] = &scrapeOutput{}
+		pending[t.Prefix] = outputs[i]
+	}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, parallelism)
+		for i, t := range list {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(t config.Target, out *scrapeOutput) {
+				defer func() { <-sem }()
+				tctx, cancel := withTargetContext(context.WithValue(ctx, scrapeOutputKey{}, out), t.Prefix)
+				defer cancel()
+				fetchC5StateMetrics(tctx, t, &wg)
+				// Queries aborted by the deadline stay pending, as they
+				// return without writing their status
+				if ctx.Err() == nil {
+					mu.Lock()
+					delete(pending, t.Prefix)
+					mu.Unlock()
+				}
+			}(t, outputs[i])
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+	if ctx.Err() == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for prefix, out := range pending {
+		// Waits for a target currently writing its metrics
+		out.mu.Lock()
+		out.late = true
+		done := out.done
+		out.mu.Unlock()
+		if done {
+			continue
+		}
+		logError("Scrape of", prefix, "not finished in time")
+		setScrapeError(prefix, "deadline")
+		setScrapeSuccess(prefix, false)
+		clearMetrics(prefix)
+		delete(pending, prefix)
+	}
+}
+
+// configFiles returns the list of configuration files for the given path.
+// If path is a directory all contained *.yml fragments are returned in
+// lexical order.
+func configFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.yml configuration fragments found in %s", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadConfiguration loads the given files into conf. Targets of all
+// files are merged, as configor only keeps the targets of one file.
+func loadConfiguration(conf *config.AppConfiguration, files []string) error {
+	err := configor.New(&configor.Config{Debug: conf.Debug}).Load(conf, files...)
+	if err != nil {
+		return err
+	}
+	var merged []config.Target
+	for _, file := range files {
+		var fragment struct{ Targets []config.Target }
+		if err := configor.New(&configor.Config{Debug: conf.Debug}).Load(&fragment, file); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for i := range fragment.Targets {
+			fragment.Targets[i].Source = file
+		}
+		merged = append(merged, fragment.Targets...)
+	}
+	conf.Targets = merged
+	return nil
+}
+
+// setConfigMtime exposes the latest modification time of the loaded
+// configuration files, so deployments can be compared across a fleet
+func setConfigMtime(files []string) {
+	var latest time.Time
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if latest.IsZero() {
+		return
+	}
+	getCounter("c5_exporter_config_mtime_seconds").Set(uint64(latest.Unix()))
+}
+
+// Time of the last successful load or reload of the configuration files
+var (
+	configLoadedMu sync.Mutex
+	configLoadedAt time.Time
+)
+
+func setConfigLoaded(t time.Time) {
+	configLoadedMu.Lock()
+	defer configLoadedMu.Unlock()
+	configLoadedAt = t
+}
+
+// setConfigAge exposes the time since the configuration files have been
+// loaded, not exported without configuration file
+func setConfigAge() {
+	configLoadedMu.Lock()
+	defer configLoadedMu.Unlock()
+	if configLoadedAt.IsZero() {
+		return
+	}
+	getFloatCounter("c5_config_age_seconds").Set(time.Since(configLoadedAt).Seconds())
+}
+
+// overrideURLHost replaces the host and/or port of the given URL. Empty
+// host or zero port leave the respective part unchanged.
+func overrideURLHost(rawURL, host string, port int) (string, error) {
+	if host == "" && port == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	h, p := u.Hostname(), u.Port()
+	if host != "" {
+		h = host
+	}
+	if port != 0 {
+		p = strconv.Itoa(port)
+	}
+	if p == "" {
+		u.Host = h
+		if strings.Contains(h, ":") {
+			u.Host = "[" + h + "]"
+		}
+	} else {
+		u.Host = net.JoinHostPort(h, p)
+	}
+	return u.String(), nil
+}
+
+// applyAddressFlags adjusts the C5 URLs using the host and port flags
+func applyAddressFlags(conf *config.AppConfiguration) error {
+	overrides := []struct {
+		url  *string
+		port int
+	}{
+		{&conf.SIPProxydURL, addressFlags.sipproxydPort},
+		{&conf.SIPProxydTrunkStatsURL, addressFlags.sipproxydPort},
+		{&conf.SIPProxydTrunkLimitsURL, addressFlags.sipproxydPort},
+		{&conf.ACDQueuedURL, addressFlags.acdqueuedPort},
+		{&conf.RegistrardURL, addressFlags.registrardPort},
+		{&conf.NotificationURL, 0},
+		{&conf.CstaURL, 0},
+	}
+	for _, o := range overrides {
+		u, err := overrideURLHost(*o.url, addressFlags.host, o.port)
+		if err != nil {
+			return err
+		}
+		*o.url = u
+	}
+	return nil
+}
+
+// buildTargets returns the list of C5 state targets to query, consisting of
+// the enabled built-in C5 processes and all additionally configured targets.
+func buildTargets(conf *config.AppConfiguration) ([]config.Target, error) {
+	var list []config.Target
+	if conf.SIPProxydEnabled {
+		list = append(list, config.Target{Prefix: "sipproxyd", URL: conf.SIPProxydURL, Daemon: "sipproxyd"})
+	}
+	if conf.ACDQueuedEnabled {
+		list = append(list, config.Target{Prefix: "acdqueued", URL: conf.ACDQueuedURL, Daemon: "acdqueued"})
+	}
+	if conf.RegistrardEnabled {
+		list = append(list, config.Target{Prefix: "registrard", URL: conf.RegistrardURL, Daemon: "registrard"})
+	}
+	if conf.NotificationEnabled {
+		list = append(list, config.Target{Prefix: "notification", URL: conf.NotificationURL, Daemon: "notification"})
+	}
+	if conf.CstaEnabled {
+		list = append(list, config.Target{Prefix: "cstagwd", URL: conf.CstaURL, Daemon: "cstagwd"})
+	}
+	list = append(list, conf.Targets...)
+
+	seen := map[string]config.Target{}
+	for _, t := range list {
+		if !prefixRegex.MatchString(t.Prefix) {
+			return nil, fmt.Errorf("invalid prefix %q for target %s", t.Prefix, t.URL)
+		}
+		if ns, ok := reservedPrefix(t.Prefix); ok {
+			return nil, fmt.Errorf("prefix %q in %s overlaps the reserved %s_ metrics", t.Prefix, t.Origin(), ns)
+		}
+		if t.URL == "" {
+			return nil, fmt.Errorf("missing url for target %s", t.Prefix)
+		}
+		if t.Verbosity != "" && !verbosityRegex.MatchString(t.Verbosity) {
+			return nil, fmt.Errorf("invalid verbosity %q for target %s", t.Verbosity, t.Prefix)
+		}
+		if t.Bundle && t.Daemon != "" {
+			return nil, fmt.Errorf("daemon of bundle target %s is selected by the process names", t.Prefix)
+		}
+		if _, ok := daemonStateFields[t.Daemon]; t.Daemon != "" && !ok {
+			return nil, fmt.Errorf("unknown daemon %q for target %s", t.Daemon, t.Prefix)
+		}
+		if t.HostHeader != "" && !hostHeaderRegex.MatchString(t.HostHeader) {
+			return nil, fmt.Errorf("invalid hostHeader %q for target %s", t.HostHeader, t.Prefix)
+		}
+		if t.Proxy != "" {
+			if _, err := parseProxyURL(t.Proxy); err != nil {
+				return nil, fmt.Errorf("%v for target %s", err, t.Prefix)
+			}
+		}
+		if other, ok := seen[t.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate prefix %q in %s and %s", t.Prefix, other.Origin(), t.Origin())
+		}
+		seen[t.Prefix] = t
+	}
+	// Metrics of a target are cleared by name prefix, which would also
+	// clear those of targets extending its prefix
+	prefixes := make([]string, 0, len(seen))
+	for prefix := range seen {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for i := 1; i < len(prefixes); i++ {
+		if a, b := seen[prefixes[i-1]], seen[prefixes[i]]; strings.HasPrefix(b.Prefix, a.Prefix) {
+			return nil, fmt.Errorf("prefix %q in %s overlaps prefix %q in %s", b.Prefix, b.Origin(), a.Prefix, a.Origin())
+		}
+	}
+	return list, nil
+}
+
+// reloadTargets re-reads the configuration at path and replaces the active
+// list of targets. Other settings require a restart of the exporter.
+func reloadTargets(path string) {
+	logInfo("Reloading targets from", path)
+	files, err := configFiles(path)
+	if err != nil {
+		logError("Failed to reload configuration:", err)
+		return
+	}
+	conf := &config.AppConfiguration{Debug: config.AppConfig.Debug}
+	if err := loadConfiguration(conf, files); err != nil {
+		logError("Failed to reload configuration:", err)
+		return
+	}
+	setConfigMtime(files)
+	if err := applyAddressFlags(conf); err != nil {
+		logError("Failed to reload configuration:", err)
+		return
+	}
+	// Counter types are only applied on startup, but an invalid configuration
+	// must not be accepted by a reload either
+	if err := validateCounterTypes(conf); err != nil {
+		logError("Failed to reload configuration:", err)
+		return
+	}
+	list, err := buildTargets(conf)
+	if err != nil {
+		logError("Failed to reload configuration:", err)
+		return
+	}
+	setConfigLoaded(time.Now())
+	changed := getCounter(`c5_config_last_reload_changed`)
+	if hashTargets(list) == hashTargets(currentTargets()) {
+		logDebug("Targets unchanged, skipping reload")
+		changed.Set(0)
+		return
+	}
+	changed.Set(1)
+	setTargets(list)
+	setTimeoutMetrics()
+	logInfo("Reloaded", len(list), "targets")
+	logTargets()
+}
+
+// hashTargets returns a hash of the given targets to detect unchanged reloads
+func hashTargets(list []config.Target) string {
+	data, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// timeoutFor returns the effective request timeout for querying the given
+// target
+func timeoutFor(target config.Target) time.Duration {
+	if target.Timeout.Duration > 0 {
+		return target.Timeout.Duration
+	} else if config.AppConfig.RequestTimeout.Duration > 0 {
+		return config.AppConfig.RequestTimeout.Duration
+	}
+	return config.AppConfig.Timeout.Duration
+}
+
+// setTimeoutMetrics exposes the global timeout and all per target overrides
+func setTimeoutMetrics() {
+	clearMetrics(`c5_exporter_timeout_seconds{`)
+	getFloatCounter(`c5_exporter_timeout_seconds`).Set(timeoutFor(config.Target{}).Seconds())
+	if timeout := config.AppConfig.ConnectTimeout; timeout.Duration > 0 {
+		getFloatCounter(`c5_exporter_connect_timeout_seconds`).Set(timeout.Seconds())
+	}
+	for _, t := range currentTargets() {
+		if t.Timeout.Duration > 0 {
+			getFloatCounter(`c5_exporter_timeout_seconds{target="` + t.Prefix + `"}`).Set(t.Timeout.Seconds())
+		}
+	}
+}
+
+func logTargets() {
+	for _, t := range currentTargets() {
+		if t.Proxy != "" {
+			logInfo(t.Prefix, "enabled with url", t.URL, "via proxy", redactProxy(t.Proxy))
+			continue
+		}
+		logInfo(t.Prefix, "enabled with url", t.URL)
+	}
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/communi5/prometheus-c5-exporter/config"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_loadConfigurationDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "10-node1.yml", `
+targets:
+  - prefix: node1_sipproxyd
+    url: http://node1:9980/c5/proxy/commands?49&1&-v
+  - prefix: node1_registrard
+    url: http://node1:9984/c5/proxy/commands?49&1&-v
+`)
+	writeFile(t, dir, "20-node2.yml", `
+targets:
+  - prefix: node2_sipproxyd
+    url: http://node2:9980/c5/proxy/commands?49&1&-v
+`)
+	writeFile(t, dir, "ignored.txt", "not a fragment")
+
+	files, err := configFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("configFiles() = %v, want 2 fragments", files)
+	}
+	conf := &config.AppConfiguration{}
+	if err := loadConfiguration(conf, files); err != nil {
+		t.Fatal(err)
+	}
+	list, err := buildTargets(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes []string
+	for _, target := range list {
+		prefixes = append(prefixes, target.Prefix)
+	}
+	if got, want := strings.Join(prefixes, ","), "node1_sipproxyd,node1_registrard,node2_sipproxyd"; got != want {
+		t.Errorf("buildTargets() prefixes = %v, want %v", got, want)
+	}
+}
+
+func Test_buildTargetsDuplicatePrefix(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yml", `
+targets:
+  - prefix: sipproxyd
+    url: http://node1:9980/c5/proxy/commands?49&1&-v
+`)
+	files, err := configFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.AppConfiguration{}
+	if err := loadConfiguration(conf, files); err != nil {
+		t.Fatal(err)
+	}
+	conf.SIPProxydEnabled = true
+	if _, err := buildTargets(conf); err == nil || !strings.Contains(err.Error(), "duplicate prefix") {
+		t.Errorf("buildTargets() error = %v, want duplicate prefix error", err)
+	}
+}
+
+func Test_buildTargetsOverlappingPrefix(t *testing.T) {
+	tests := []struct {
+		prefixes []string
+		wantErr  bool
+	}{
+		{[]string{"node2", "node2_sipproxyd"}, true},
+		{[]string{"node20", "node2"}, true},
+		{[]string{"node1_sipproxyd", "node2_sipproxyd", "node1_registrard"}, false},
+	}
+	for _, tt := range tests {
+		conf := &config.AppConfiguration{}
+		for _, prefix := range tt.prefixes {
+			conf.Targets = append(conf.Targets, config.Target{Prefix: prefix, URL: "http://localhost:9980/c5/proxy/commands?49&1&-v"})
+		}
+		_, err := buildTargets(conf)
+		if (err != nil) != tt.wantErr || (err != nil && !strings.Contains(err.Error(), "overlaps prefix")) {
+			t.Errorf("buildTargets(%v) error = %v, wantErr %v", tt.prefixes, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_buildTargetsReservedPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{"c5", true},
+		{"c5_node2", true},
+		{"c", true},
+		{"xms", true},
+		{"xms_node2", true},
+		{"selftest_sipproxyd", true},
+		{"debug", true},
+		{"c5x", false},
+		{"node2_c5", false},
+	}
+	for _, tt := range tests {
+		conf := &config.AppConfiguration{Targets: []config.Target{{Prefix: tt.prefix, URL: "http://localhost:9980/c5/proxy/commands?49&1&-v"}}}
+		_, err := buildTargets(conf)
+		if (err != nil) != tt.wantErr || (err != nil && !strings.Contains(err.Error(), "reserved")) {
+			t.Errorf("buildTargets(%q) error = %v, wantErr %v", tt.prefix, err, tt.wantErr)
+		}
+	}
+
+	// A reload with a reserved prefix keeps the current targets
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yml", "targets:\n  - prefix: test_reserved\n    url: http://node1:9980/\n")
+	defer setTargets(currentTargets())
+	reloadTargets(dir)
+	writeFile(t, dir, "a.yml", "targets:\n  - prefix: c5_node1\n    url: http://node1:9980/\n")
+	reloadTargets(dir)
+	if list := currentTargets(); len(list) != 1 || list[0].Prefix != "test_reserved" {
+		t.Errorf("reloadTargets() with reserved prefix targets = %v, want test_reserved", list)
+	}
+}
+
+func Test_buildTargetsDaemon(t *testing.T) {
+	conf := &config.AppConfiguration{
+		RegistrardEnabled: true,
+		RegistrardURL:     "http://localhost:9983/c5/proxy/commands?49&1&-v",
+		Targets:           []config.Target{{Prefix: "node2_registrard", URL: "http://node2:9983/c5/proxy/commands?49&1&-v", Daemon: "registrard"}},
+	}
+	list, err := buildTargets(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range list {
+		if target.Daemon != "registrard" {
+			t.Errorf("buildTargets() daemon of %s = %q, want registrard", target.Prefix, target.Daemon)
+		}
+	}
+	conf.Targets[0].Daemon = "registrar"
+	if _, err := buildTargets(conf); err == nil || !strings.Contains(err.Error(), "unknown daemon") {
+		t.Errorf("buildTargets() error = %v, want unknown daemon error", err)
+	}
+	conf.Targets[0].Daemon, conf.Targets[0].Bundle = "registrard", true
+	if _, err := buildTargets(conf); err == nil || !strings.Contains(err.Error(), "bundle") {
+		t.Errorf("buildTargets() error = %v, want bundle daemon error", err)
+	}
+}
+
+func Test_buildTargetsHostHeader(t *testing.T) {
+	tests := []struct {
+		hostHeader string
+		wantErr    bool
+	}{
+		{"", false},
+		{"c5-node2.example.com", false},
+		{"c5-node2.example.com:9980", false},
+		{"[fd00::2]:9980", false},
+		{"c5-node2.example.com/c5", true},
+		{"c5 node2", true},
+	}
+	for _, tt := range tests {
+		conf := &config.AppConfiguration{
+			Targets: []config.Target{{Prefix: "node2_sipproxyd", URL: "http://localhost:19980/c5/proxy/commands?49&1&-v", HostHeader: tt.hostHeader}},
+		}
+		if _, err := buildTargets(conf); (err != nil) != tt.wantErr {
+			t.Errorf("buildTargets() hostHeader %q error = %v, wantErr %v", tt.hostHeader, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_overrideURLHost(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		host string
+		port int
+		want string
+	}{
+		{"unchanged", "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "", 0, "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v"},
+		{"port", "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "", 19980, "http://127.0.0.1:19980/c5/proxy/commands?49&1&-v"},
+		{"host", "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "10.0.0.2", 0, "http://10.0.0.2:9980/c5/proxy/commands?49&1&-v"},
+		{"host and port", "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "c5-node", 19980, "http://c5-node:19980/c5/proxy/commands?49&1&-v"},
+		{"ipv6 host", "http://127.0.0.1:9980/c5/proxy/commands?49&1&-v", "::1", 0, "http://[::1]:9980/c5/proxy/commands?49&1&-v"},
+		{"no port", "http://localhost/c5", "c5-node", 0, "http://c5-node/c5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := overrideURLHost(tt.url, tt.host, tt.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("overrideURLHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_trackVanishedCounters(t *testing.T) {
+	vanished := metricSet.GetOrCreateCounter(`c5_counters_vanished_total{target="test_vanished"}`)
+	trackVanishedCounters("test_vanished", "2021-01-01", map[string]bool{"A": true, "B": true, "C": true})
+	trackVanishedCounters("test_vanished", "2021-01-01", map[string]bool{"A": true, "C": true})
+	if got := vanished.Get(); got != 1 {
+		t.Errorf("trackVanishedCounters() vanished = %v, want 1", got)
+	}
+	// Restart of the C5 process resets tracking
+	trackVanishedCounters("test_vanished", "2021-01-02", map[string]bool{"A": true})
+	if got := vanished.Get(); got != 1 {
+		t.Errorf("trackVanishedCounters() vanished after restart = %v, want 1", got)
+	}
+	trackVanishedCounters("test_vanished", "2021-01-02", map[string]bool{})
+	if got := vanished.Get(); got != 2 {
+		t.Errorf("trackVanishedCounters() vanished = %v, want 2", got)
+	}
+}
+
+func Test_trackVanishedCountersTotals(t *testing.T) {
+	defer dropTargetState("test_totals")
+	eventCounterDelta("test_totals", "test_totals_a_total", 1)
+	eventCounterDelta("test_totals", "test_totals_b_total", 1)
+	trackVanishedCounters("test_totals", "2021-01-01", map[string]bool{"A": true, "B": true})
+	eventCounterDelta("test_totals", "test_totals_a_total", 2)
+	trackVanishedCounters("test_totals", "2021-01-01", map[string]bool{"A": true})
+	st := stateFor("test_totals")
+	if _, ok := st.totals["test_totals_b_total"]; ok || len(st.totals) != 1 {
+		t.Errorf("trackVanishedCounters() totals = %v, want only test_totals_a_total", st.totals)
+	}
+	// A reappearing counter starts over
+	if _, ok := eventCounterDelta("test_totals", "test_totals_b_total", 5); ok {
+		t.Error("eventCounterDelta() of reappeared counter = true, want false")
+	}
+}
+
+func Test_scrapeTargetsParallelism(t *testing.T) {
+	var active, maxActive int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		for {
+			max := atomic.LoadInt64(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt64(&maxActive, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	var list []config.Target
+	for i := 0; i < 6; i++ {
+		prefix := "test_parallel" + strconv.Itoa(i)
+		list = append(list, config.Target{Prefix: prefix, URL: srv.URL + "/" + prefix})
+		defer clearMetrics(prefix)
+	}
+	scrapeTargets(context.Background(), list, 2)
+	if got := atomic.LoadInt64(&maxActive); got != 2 {
+		t.Errorf("scrapeTargets() max concurrent queries = %v, want 2", got)
+	}
+}
+
+func Test_reloadTargetsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+targets:
+  - prefix: test_reload
+    url: http://node1:9980/c5/proxy/commands?49&1&-v
+`
+	writeFile(t, dir, "a.yml", content)
+	defer setTargets(currentTargets())
+	changed := metricSet.GetOrCreateCounter(`c5_config_last_reload_changed`)
+
+	reloadTargets(dir)
+	if got := changed.Get(); got != 1 {
+		t.Errorf("reloadTargets() changed = %v, want 1", got)
+	}
+	reloadTargets(dir)
+	if got := changed.Get(); got != 0 {
+		t.Errorf("reloadTargets() of unchanged targets changed = %v, want 0", got)
+	}
+	writeFile(t, dir, "a.yml", strings.Replace(content, "node1", "node2", 1))
+	reloadTargets(dir)
+	if got := changed.Get(); got != 1 {
+		t.Errorf("reloadTargets() changed = %v, want 1", got)
+	}
+	if got := currentTargets()[0].URL; !strings.Contains(got, "node2") {
+		t.Errorf("reloadTargets() url = %v, want node2", got)
+	}
+}
+
+func Test_reloadTargetsUnknownCounterType(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yml", "targets:\n  - prefix: test_types\n    url: http://node1:9980/\n")
+	defer setTargets(currentTargets())
+	reloadTargets(dir)
+	writeFile(t, dir, "a.yml", "countertypes:\n  NO_SUCH_COUNTER: gauge\ntargets:\n  - prefix: test_types\n    url: http://node2:9980/\n")
+	reloadTargets(dir)
+	if list := currentTargets(); len(list) != 1 || list[0].URL != "http://node1:9980/" {
+		t.Errorf("reloadTargets() with unknown counter type targets = %v, want node1", list)
+	}
+}
+
+func Test_loadConfigurationCounterTypes(t *testing.T) {
+	file := writeFile(t, t.TempDir(), "c5.conf", `
+[counterTypes]
+TRANSPORT_MESSAGE_IN = "gauge"
+`)
+	conf := &config.AppConfiguration{}
+	if err := loadConfiguration(conf, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.CounterTypes["TRANSPORT_MESSAGE_IN"]; got != "gauge" {
+		t.Errorf("loadConfiguration() counterTypes = %v, want gauge", conf.CounterTypes)
+	}
+}
+
+func Test_scrapeTargetsDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "slow") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer close(release)
+	defer clearMetrics("test_deadline")
+	list := []config.Target{
+		{Prefix: "test_deadline_fast", URL: srv.URL + "/fast"},
+		{Prefix: "test_deadline_slow", URL: srv.URL + "/slow"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	scrapeTargets(ctx, list, 2)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("scrapeTargets() took %v despite deadline", elapsed)
+	}
+	if got := metricSet.GetOrCreateCounter("test_deadline_fast_state").Get(); got != 1 {
+		t.Errorf("scrapeTargets() fast state = %v, want 1", got)
+	}
+	deadline := metricSet.GetOrCreateCounter(`c5_scrape_errors_total{target="test_deadline_slow",reason="deadline"}`)
+	if got := deadline.Get(); got != 1 {
+		t.Errorf("scrapeTargets() slow deadline errors = %v, want 1", got)
+	}
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_deadline_slow_") {
+			t.Errorf("scrapeTargets() exported metric %s of timed out target", name)
+		}
+	}
+
+	// The abandoned query must not expose its status once it returns
+	active := metricSet.GetOrCreateCounter("c5_active_scrape_goroutines")
+	for wait := time.Now(); active.Get() > 0 && time.Since(wait) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, name := range metricSet.ListMetricNames() {
+		if name == `c5_scrape_duration_seconds{target="test_deadline_slow"}` {
+			t.Errorf("abandoned query exported %s", name)
+		}
+	}
+	if got := metricSet.GetOrCreateCounter(`c5_scrape_success{target="test_deadline_slow"}`).Get(); got != 0 {
+		t.Errorf("abandoned query c5_scrape_success = %v, want 0", got)
+	}
+}
+
+func Test_lockScrapeOutput(t *testing.T) {
+	out := &scrapeOutput{}
+	ctx := context.WithValue(context.Background(), scrapeOutputKey{}, out)
+	release, ok := lockScrapeOutput(ctx)
+	if !ok {
+		t.Fatal("lockScrapeOutput() before deadline = false, want true")
+	}
+	release()
+	if !out.done {
+		t.Error("lockScrapeOutput() release did not mark output done")
+	}
+
+	// The deadline branch of scrapeTargets marks pending outputs as late
+	late := &scrapeOutput{late: true}
+	ctx = context.WithValue(context.Background(), scrapeOutputKey{}, late)
+	if _, ok := lockScrapeOutput(ctx); ok {
+		t.Error("lockScrapeOutput() after deadline = true, want false")
+	}
+	if late.done {
+		t.Error("lockScrapeOutput() marked late output done")
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := lockScrapeOutput(canceled); ok {
+		t.Error("lockScrapeOutput() with canceled context = true, want false")
+	}
+}
+
+func Test_reloadTargetsCancelsScrapes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "hang") {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer setTargets(currentTargets())
+	dir := t.TempDir()
+	reload := func(path string) {
+		writeFile(t, dir, "a.yml", "targets:\n  - prefix: test_cancel\n    url: "+srv.URL+path+"\n")
+		reloadTargets(dir)
+	}
+
+	var before int
+	for i := 0; i < 5; i++ {
+		reload("/hang")
+		if i == 1 {
+			before = runtime.NumGoroutine()
+		}
+		finished := make(chan struct{})
+		go func() {
+			scrapeTargets(context.Background(), currentTargets(), 1)
+			close(finished)
+		}()
+		// Wait for the request to hang before reloading
+		time.Sleep(20 * time.Millisecond)
+		reload("/ok")
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatal("scrapeTargets() not cancelled by reload")
+		}
+	}
+	c5Transport.CloseIdleConnections()
+	// Allow the server side of the aborted requests to finish
+	time.Sleep(20 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Errorf("goroutines after reloads = %v, want at most %v", after, before+2)
+	}
+	reloadTargets(dir)
+	scrapeTargets(context.Background(), currentTargets(), 1)
+	if got := metricSet.GetOrCreateCounter("test_cancel_state").Get(); got != 1 {
+		t.Errorf("scrapeTargets() state after reload = %v, want 1", got)
+	}
+}
+
+func Test_setTargetsClearsRemovedTargets(t *testing.T) {
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_removed", URL: "http://c5"}})
+	metricSet.GetOrCreateCounter("test_removed_state").Set(1)
+	setTargets(nil)
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_removed") {
+			t.Errorf("setTargets() kept metric %s of removed target", name)
+		}
+	}
+}
+
+func Test_scrapeTargetsMinScrapeInterval(t *testing.T) {
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer func() { config.AppConfig.MinScrapeInterval.Duration = 0 }()
+	config.AppConfig.MinScrapeInterval.Duration = time.Hour
+
+	list := []config.Target{{Prefix: "test_throttle", URL: srv.URL}}
+	cached := metricSet.GetOrCreateCounter(`c5_scrape_cached{target="test_throttle"}`)
+	scrapeTargets(context.Background(), list, 1)
+	if got := cached.Get(); got != 0 {
+		t.Errorf("scrapeTargets() first scrape c5_scrape_cached = %v, want 0", got)
+	}
+	scrapeTargets(context.Background(), list, 1)
+	if got := cached.Get(); got != 1 {
+		t.Errorf("scrapeTargets() second scrape c5_scrape_cached = %v, want 1", got)
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Errorf("scrapeTargets() queried C5 %v times, want 1", got)
+	}
+	if got := metricSet.GetOrCreateCounter("test_throttle_state").Get(); got != 1 {
+		t.Errorf("scrapeTargets() cached state = %v, want 1", got)
+	}
+}
+
+func Test_trackScrapeGoroutine(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer clearMetrics("test_goroutines")
+
+	active := metricSet.GetOrCreateCounter("c5_active_scrape_goroutines")
+	before := active.Get()
+	finished := make(chan struct{})
+	go func() {
+		scrapeTargets(context.Background(), []config.Target{{Prefix: "test_goroutines", URL: srv.URL}}, 1)
+		close(finished)
+	}()
+	for i := 0; active.Get() != before+1; i++ {
+		if i > 100 {
+			t.Fatalf("c5_active_scrape_goroutines = %v during scrape, want %v", active.Get(), before+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	<-finished
+	if got := active.Get(); got != before {
+		t.Errorf("c5_active_scrape_goroutines = %v after scrape, want %v", got, before)
+	}
+}
+
+func Test_setConfigMtime(t *testing.T) {
+	dir := t.TempDir()
+	older := writeFile(t, dir, "a.yml", "targets: []\n")
+	newer := writeFile(t, dir, "b.yml", "targets: []\n")
+	mtime := time.Unix(1600000000, 0)
+	if err := os.Chtimes(older, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(newer, mtime.Add(time.Hour), mtime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	metricSet.UnregisterMetric("c5_exporter_config_mtime_seconds")
+	defer metricSet.UnregisterMetric("c5_exporter_config_mtime_seconds")
+	setConfigMtime(nil)
+	for _, name := range metricSet.ListMetricNames() {
+		if name == "c5_exporter_config_mtime_seconds" {
+			t.Fatal("setConfigMtime() exported mtime without configuration file")
+		}
+	}
+	setConfigMtime([]string{older, newer})
+	if got, want := metricSet.GetOrCreateCounter("c5_exporter_config_mtime_seconds").Get(), uint64(mtime.Add(time.Hour).Unix()); got != want {
+		t.Errorf("c5_exporter_config_mtime_seconds = %v, want %v", got, want)
+	}
+}
+
+func Test_setConfigAge(t *testing.T) {
+	defer setConfigLoaded(time.Time{})
+	defer setTargets(currentTargets())
+	metricSet.UnregisterMetric("c5_config_age_seconds")
+	defer metricSet.UnregisterMetric("c5_config_age_seconds")
+	setConfigLoaded(time.Time{})
+	setConfigAge()
+	for _, name := range metricSet.ListMetricNames() {
+		if name == "c5_config_age_seconds" {
+			t.Fatal("setConfigAge() exported age without configuration file")
+		}
+	}
+	age := metricSet.GetOrCreateFloatCounter("c5_config_age_seconds")
+	setConfigLoaded(time.Now().Add(-time.Hour))
+	setConfigAge()
+	if got := age.Get(); got < 3600 || got > 3660 {
+		t.Errorf("c5_config_age_seconds = %v, want 3600", got)
+	}
+
+	// Only successful reloads reset the age
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yml", "targets:\n  - prefix: test-age\n    url: http://node1:9980\n")
+	reloadTargets(dir)
+	setConfigAge()
+	if got := age.Get(); got < 3600 {
+		t.Errorf("c5_config_age_seconds after failed reload = %v, want 3600", got)
+	}
+	writeFile(t, dir, "a.yml", "targets:\n  - prefix: test_age\n    url: http://node1:9980\n")
+	reloadTargets(dir)
+	setConfigAge()
+	if got := age.Get(); got >= 60 {
+		t.Errorf("c5_config_age_seconds after reload = %v, want 0", got)
+	}
+}
+
+func Test_setBuildsSeen(t *testing.T) {
+	defer clearMetrics("test_builds")
+	defer setBuildsSeen()
+	setBuildVersion("test_builds_a", "9.9.0.1")
+	processBaseMetrics(config.Target{Prefix: "test_builds_b"}, c5StateResponse{BuildVersion: "Version: 9.9.0.2, compiled on Jan 15 2020, 13:06:31"})
+	setBuildVersion("test_builds_c", "9.9.0.1")
+	setBuildVersion("test_builds_d", "")
+	seen := func() map[string]uint64 {
+		setBuildsSeen()
+		got := map[string]uint64{}
+		for _, name := range metricSet.ListMetricNames() {
+			if strings.HasPrefix(name, `c5_builds_seen{version="9.9.`) {
+				got[name] = metricSet.GetOrCreateCounter(name).Get()
+			}
+		}
+		return got
+	}
+	want := map[string]uint64{`c5_builds_seen{version="9.9.0.1"}`: 2, `c5_builds_seen{version="9.9.0.2"}`: 1}
+	if got := seen(); !reflect.DeepEqual(got, want) {
+		t.Errorf("setBuildsSeen() = %v, want %v", got, want)
+	}
+	// Failed queries clear the metrics of a target and with it its version
+	clearMetrics("test_builds_b")
+	want = map[string]uint64{`c5_builds_seen{version="9.9.0.1"}`: 2}
+	if got := seen(); !reflect.DeepEqual(got, want) {
+		t.Errorf("setBuildsSeen() after clearMetrics() = %v, want %v", got, want)
+	}
+}
+
+func Test_setBuildsSeenSelftest(t *testing.T) {
+	seen := func() map[string]uint64 {
+		setBuildsSeen()
+		got := map[string]uint64{}
+		for _, name := range metricSet.ListMetricNames() {
+			if strings.HasPrefix(name, "c5_builds_seen{") {
+				got[name] = metricSet.GetOrCreateCounter(name).Get()
+			}
+		}
+		return got
+	}
+	before := seen()
+	// Validating counter types on startup and the self-test must not count
+	// the versions of the embedded samples
+	if err := validateCounterTypes(&config.AppConfiguration{CounterTypes: map[string]string{"WS_CONNECTIONS": "counter"}}); err != nil {
+		t.Fatal(err)
+	}
+	runSelftest()
+	if got := seen(); !reflect.DeepEqual(got, before) {
+		t.Errorf("setBuildsSeen() after self-test = %v, want %v", got, before)
+	}
+}
+
+func Test_allowSeries(t *testing.T) {
+	defer setTargets(currentTargets())
+	setTargets([]config.Target{{Prefix: "test_series", URL: "http://localhost:9980"}})
+	defer clearMetrics("test_series")
+	defer func() { config.AppConfig.MaxSeriesPerTarget = 0 }()
+	config.AppConfig.MaxSeriesPerTarget = 2
+	hits := metricSet.GetOrCreateCounter(`c5_series_limit_hit_total{target="test_series"}`)
+	hits.Set(0)
+
+	setMetricValue("test_series_a", 1)
+	setMetricValue("test_series_b", 1)
+	setMetricValue("test_series_c", 1)
+	setMetricValue("test_series_a", 2)
+	setMetricValue("other_d", 1)
+	defer metricSet.UnregisterMetric("other_d")
+	var names []string
+	for _, name := range metricSet.ListMetricNames() {
+		if strings.HasPrefix(name, "test_series_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if want := []string{"test_series_a", "test_series_b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("setMetricValue() registered %v, want %v", names, want)
+	}
+	if got := metricSet.GetOrCreateCounter("test_series_a").Get(); got != 2 {
+		t.Errorf("setMetricValue() didn't update existing series, got %v", got)
+	}
+	if got := hits.Get(); got != 1 {
+		t.Errorf("c5_series_limit_hit_total = %v, want 1", got)
+	}
+
+	// Cleared series no longer count against the limit
+	clearMetrics("test_series_b")
+	setMetricValue("test_series_c", 1)
+	if got := metricSet.GetOrCreateCounter("test_series_c").Get(); got != 1 {
+		t.Errorf("setMetricValue() dropped series after clearing others, got %v", got)
+	}
+}
+
+func Test_setNeverSucceeded(t *testing.T) {
+	var status int32 = http.StatusNotFound
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(testStateResponse))
+	}))
+	defer srv.Close()
+	defer setTargets(currentTargets())
+	defer clearMetrics("test_never")
+	target := config.Target{Prefix: "test_never", URL: srv.URL}
+	setTargets([]config.Target{target})
+	name := `c5_target_never_succeeded{target="test_never"}`
+
+	tests := []struct {
+		name   string
+		status int32
+		target config.Target
+		want   uint64
+	}{
+		{"failing", http.StatusNotFound, target, 1},
+		{"succeeded", http.StatusOK, target, 0},
+		{"failing again", http.StatusNotFound, target, 0},
+		{"changed target", http.StatusNotFound, config.Target{Prefix: "test_never", URL: srv.URL + "/typo"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTargets([]config.Target{tt.target})
+			atomic.StoreInt32(&status, tt.status)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			fetchC5StateMetrics(context.Background(), tt.target, &wg)
+			if got := metricSet.GetOrCreateCounter(name).Get(); got != tt.want {
+				t.Errorf("%s = %v, want %v", name, got, tt.want)
+			}
+		})
+	}
+	setTargets(nil)
+	for _, m := range metricSet.ListMetricNames() {
+		if m == name {
+			t.Errorf("%s still exported after removing the target", name)
+		}
+	}
+}